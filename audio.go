@@ -0,0 +1,236 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/KarpelesLab/ffprobe"
+	"github.com/KarpelesLab/runutil"
+)
+
+var (
+	forceAudioTranscode = flag.Bool("force_audio_transcode", false, "always transcode audio, even tracks that could be copied as is")
+)
+
+// AudioRung is an audio rendition of the ladder, encoded for each audio track
+// of the source. Zero values mean the built-in default for the codec.
+type AudioRung struct {
+	Codec    string `json:"codec"`              // aac, he-aac, opus, ac3 or eac3
+	Bitrate  uint64 `json:"bitrate,omitempty"`  // bits/s
+	Channels int    `json:"channels,omitempty"` // 2 by default, surround rungs are only used for surround sources
+
+	copied bool // source tracks copied as is, not part of the ladder
+}
+
+// audioTrack is the information on a source audio track that is not part of
+// ffprobe.Stream
+type audioTrack struct {
+	Index    int    `json:"index"`
+	Channels int    `json:"channels"`
+	BitRate  uint64 `json:"bit_rate,string"`
+}
+
+type audioCodec struct {
+	encoder  string   // ffmpeg encoder
+	args     []string // extra encoder arguments
+	external bool     // encoder is an optional ffmpeg dependency
+	channels int      // maximum number of channels
+	stereo   uint64   // default bitrates
+	surround uint64
+}
+
+var audioCodecs = map[string]*audioCodec{
+	"aac":    {encoder: "aac", channels: 8, stereo: 96000, surround: 384000},
+	"he-aac": {encoder: "libfdk_aac", args: []string{"-profile:a", "aac_he"}, external: true, channels: 8, stereo: 48000, surround: 160000},
+	"opus":   {encoder: "libopus", external: true, channels: 8, stereo: 96000, surround: 256000},
+	"ac3":    {encoder: "ac3", channels: 6, stereo: 192000, surround: 384000},
+	"eac3":   {encoder: "eac3", channels: 6, stereo: 128000, surround: 256000},
+}
+
+// defaultAudioLadder returns the built-in audio ladder: a single AAC stereo
+// rendition
+func defaultAudioLadder() []*AudioRung {
+	return []*AudioRung{{Codec: "aac", Bitrate: 96000, Channels: 2}}
+}
+
+func (r *AudioRung) validate() error {
+	c, ok := audioCodecs[r.Codec]
+	if !ok {
+		return fmt.Errorf("unsupported audio codec %s", r.Codec)
+	}
+	if r.Channels < 0 || r.Channels > c.channels {
+		return fmt.Errorf("%d channels not supported for %s", r.Channels, r.Codec)
+	}
+	if r.Bitrate != 0 && r.Bitrate < 8000 {
+		return errors.New("audio bitrate is too low")
+	}
+	return nil
+}
+
+func (r *AudioRung) String() string {
+	return fmt.Sprintf("%s@%dk/%dch", r.Codec, r.bitrate()/1000, r.channels())
+}
+
+// channels returns the number of output channels of r
+func (r *AudioRung) channels() int {
+	if r.Channels > 0 {
+		return r.Channels
+	}
+	return 2
+}
+
+// surround returns true if r has more than two channels
+func (r *AudioRung) surround() bool {
+	return r.channels() > 2
+}
+
+// bitrate returns the target bitrate of r
+func (r *AudioRung) bitrate() uint64 {
+	if r.Bitrate > 0 {
+		return r.Bitrate
+	}
+	c := audioCodecs[r.Codec]
+	if r.surround() {
+		return c.surround
+	}
+	return c.stereo
+}
+
+// groupID returns the EXT-X-MEDIA GROUP-ID of the renditions of r, such as
+// "aac-2ch-96k", or "eac3-6ch-copy" for copied tracks
+func (r *AudioRung) groupID() string {
+	if r.copied {
+		return fmt.Sprintf("%s-%dch-copy", r.Codec, r.channels())
+	}
+	return fmt.Sprintf("%s-%dch-%dk", r.Codec, r.channels(), r.bitrate()/1000)
+}
+
+// args returns the ffmpeg encoding arguments of r
+func (r *AudioRung) args() []string {
+	c := audioCodecs[r.Codec]
+	res := append([]string{"-c:a", c.encoder}, c.args...)
+	return append(res,
+		"-b:a", strconv.FormatUint(r.bitrate(), 10),
+		"-ac", strconv.Itoa(r.channels()),
+	)
+}
+
+// prepareAudio selects the audio rungs of ladder that ffmpeg can encode, and
+// probes the number of channels of the source audio tracks
+func (hls *hlsBuilder) prepareAudio(ladder *Ladder) error {
+	hls.audioRungs = nil
+	for _, r := range ladder.Audio {
+		if c := audioCodecs[r.Codec]; c.external && !ffmpegHas("encoders", c.encoder) {
+			log.Printf("audio: ffmpeg has no %s encoder, skipping %s", c.encoder, r)
+			continue
+		}
+		hls.audioRungs = append(hls.audioRungs, r)
+	}
+	if len(hls.audios) == 0 {
+		return nil
+	}
+	if *loudnormTarget != 0 {
+		if err := checkLoudnorm(); err != nil {
+			return err
+		}
+	}
+	if len(hls.audioRungs) == 0 {
+		return errors.New("no usable audio rendition in ladder")
+	}
+
+	var res struct {
+		Streams []*audioTrack `json:"streams"`
+	}
+	err := runutil.RunJson(&res, exe("ffprobe"), "-print_format", "json", "-hide_banner", "-loglevel", "warning", "-select_streams", "a", "-show_entries", "stream=index,channels,bit_rate", hls.input)
+	if err != nil {
+		return fmt.Errorf("ffprobe failed: %w", err)
+	}
+	hls.tracks = make(map[int]*audioTrack)
+	for _, t := range res.Streams {
+		hls.tracks[t.Index] = t
+	}
+
+	log.Printf("will be generating the following audio renditions: %v", hls.audioRungs)
+	return nil
+}
+
+// track returns the probed information on the source track src
+func (hls *hlsBuilder) track(src *ffprobe.Stream) *audioTrack {
+	if t, ok := hls.tracks[src.Index]; ok {
+		return t
+	}
+	return &audioTrack{Index: src.Index}
+}
+
+// audioRungsFor returns the audio rungs to encode for the source track src,
+// surround rungs requiring a source with more than two channels
+func (hls *hlsBuilder) audioRungsFor(src *ffprobe.Stream) []*AudioRung {
+	var res []*AudioRung
+	for _, r := range hls.audioRungs {
+		if r.surround() && hls.track(src).Channels <= 2 {
+			continue
+		}
+		res = append(res, r)
+	}
+	return res
+}
+
+// sourceAudioCodec returns the audio ladder codec matching the source track
+// src, or an empty string if it has no match or is not usable as is in HLS
+func sourceAudioCodec(src *ffprobe.Stream) string {
+	if src.SampleRate > 48000 {
+		return ""
+	}
+	switch src.CodecName {
+	case "aac":
+		switch src.Profile {
+		case "LC":
+			return "aac"
+		case "HE-AAC":
+			return "he-aac"
+		}
+	case "opus", "ac3", "eac3":
+		return src.CodecName
+	}
+	return ""
+}
+
+// copyRung returns the rung the source track src can be copied to instead of
+// being transcoded, or nil. This is the first rung of audioRungsFor(src) with
+// the codec and channels of src, if src is at most twice its bitrate or has
+// no known bitrate, so the track stays in the same group as other tracks
+// encoded for this rung. Otherwise, a rung outside of the ladder is returned
+// so the track is copied in its own group, in addition to the renditions
+// encoded for the ladder.
+//
+// The twice the bitrate limit is deliberate: it keeps the copied track in
+// its group (and avoids doubling the variants listed per group) as long as
+// the renditions of the group stay within the same bitrate range, which
+// BANDWIDTH accounts for as it is measured on the largest rendition. Only
+// the matching rung is replaced, the other rungs are still encoded.
+func (hls *hlsBuilder) copyRung(src *ffprobe.Stream) *AudioRung {
+	if *forceAudioTranscode {
+		return nil
+	}
+	codec := sourceAudioCodec(src)
+	if codec == "" {
+		return nil
+	}
+	if *loudnormTarget != 0 {
+		log.Printf("audio: transcoding track #%d although %s can be copied, as -loudnorm requires it", src.Index, codec)
+		return nil
+	}
+	t := hls.track(src)
+	if t.Channels == 0 {
+		return nil
+	}
+	for _, r := range hls.audioRungsFor(src) {
+		if r.Codec == codec && r.channels() == t.Channels && (t.BitRate == 0 || t.BitRate <= 2*r.bitrate()) {
+			return r
+		}
+	}
+	return &AudioRung{Codec: codec, Bitrate: t.BitRate, Channels: t.Channels, copied: true}
+}
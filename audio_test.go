@@ -0,0 +1,129 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/KarpelesLab/ffprobe"
+)
+
+func TestAudioLadder(t *testing.T) {
+	writeLadder := setLadder(t)
+	writeLadder(`{"rungs": [{"height": 0, "codec": "h264"}], "audio": [
+		{"codec": "aac", "bitrate": 128000},
+		{"codec": "he-aac"},
+		{"codec": "ac3", "channels": 6}
+	]}`)
+	l, err := loadLadder()
+	if err != nil {
+		t.Fatalf("failed to load ladder: %s", err)
+	}
+	hls := &hlsBuilder{audioRungs: l.Audio, tracks: map[int]*audioTrack{1: {Channels: 2}, 2: {Channels: 6}}}
+
+	var ids []string
+	for _, r := range hls.audioRungsFor(&ffprobe.Stream{Index: 1}) {
+		ids = append(ids, r.groupID())
+	}
+	if s := strings.Join(ids, " "); s != "aac-2ch-128k he-aac-2ch-48k" {
+		t.Errorf("unexpected stereo renditions %s", s)
+	}
+	if rs := hls.audioRungsFor(&ffprobe.Stream{Index: 2}); len(rs) != 3 {
+		t.Errorf("unexpected surround renditions %v", rs)
+	} else if args := strings.Join(rs[2].args(), " "); args != "-c:a ac3 -b:a 384000 -ac 6" {
+		t.Errorf("unexpected arguments %s", args)
+	}
+
+	// default audio ladder
+	writeLadder(`{"rungs": [{"height": 0, "codec": "h264"}]}`)
+	if l, err := loadLadder(); err != nil || len(l.Audio) != 1 || strings.Join(l.Audio[0].args(), " ") != "-c:a aac -b:a 96000 -ac 2" {
+		t.Errorf("unexpected default audio ladder %v (%v)", l, err)
+	}
+
+	invalid := []string{
+		`{"rungs": [{"codec": "h264"}], "audio": [{"codec": "mp3"}]}`,
+		`{"rungs": [{"codec": "h264"}], "audio": [{"codec": "ac3", "channels": 8}]}`,
+		`{"rungs": [{"codec": "h264"}], "audio": [{"codec": "aac", "bitrate": 96}]}`,
+	}
+	for _, src := range invalid {
+		writeLadder(src)
+		if _, err := loadLadder(); err == nil {
+			t.Errorf("expected error loading %s", src)
+		}
+	}
+}
+
+func TestAudioPassthrough(t *testing.T) {
+	rungs := []*AudioRung{{Codec: "aac", Bitrate: 128000}, {Codec: "aac", Bitrate: 64000}, {Codec: "eac3", Channels: 6}}
+	hls := &hlsBuilder{audioRungs: rungs, tracks: map[int]*audioTrack{
+		1: {Channels: 2, BitRate: 192000},
+		2: {Channels: 2, BitRate: 320000},
+		3: {Channels: 6, BitRate: 640000},
+		4: {Channels: 6, BitRate: 448000},
+		5: {Channels: 2},
+		6: {},
+		7: {Channels: 2, BitRate: 256000},
+		8: {Channels: 2, BitRate: 256001},
+	}}
+	tests := []struct {
+		src    *ffprobe.Stream
+		expect *AudioRung
+	}{
+		{&ffprobe.Stream{Index: 1, CodecName: "aac", Profile: "LC", SampleRate: 48000}, rungs[0]},
+		{&ffprobe.Stream{Index: 1, CodecName: "aac", Profile: "HE-AACv2", SampleRate: 48000}, nil},
+		{&ffprobe.Stream{Index: 1, CodecName: "aac", Profile: "LC", SampleRate: 96000}, nil},
+		{&ffprobe.Stream{Index: 4, CodecName: "eac3", SampleRate: 48000}, rungs[2]},
+		{&ffprobe.Stream{Index: 4, CodecName: "dts", SampleRate: 48000}, nil},
+		{&ffprobe.Stream{Index: 5, CodecName: "aac", Profile: "LC", SampleRate: 48000}, rungs[0]}, // unknown bitrate
+		{&ffprobe.Stream{Index: 6, CodecName: "aac", Profile: "LC", SampleRate: 48000}, nil},      // unknown channels
+		{&ffprobe.Stream{Index: 7, CodecName: "aac", Profile: "LC", SampleRate: 48000}, rungs[0]}, // twice the rung bitrate
+	}
+	for n, tt := range tests {
+		if r := hls.copyRung(tt.src); r != tt.expect {
+			t.Errorf("test %d: expected %v, got %v", n, tt.expect, r)
+		}
+	}
+
+	// tracks without a matching rung are copied in their own group
+	own := []struct {
+		src   *ffprobe.Stream
+		group string
+	}{
+		{&ffprobe.Stream{Index: 2, CodecName: "aac", Profile: "LC", SampleRate: 48000}, "aac-2ch-copy"}, // bitrate too high
+		{&ffprobe.Stream{Index: 8, CodecName: "aac", Profile: "LC", SampleRate: 48000}, "aac-2ch-copy"}, // over twice the rung bitrate
+		{&ffprobe.Stream{Index: 3, CodecName: "eac3", SampleRate: 48000}, "eac3-6ch-copy"},
+		{&ffprobe.Stream{Index: 3, CodecName: "opus", SampleRate: 48000}, "opus-6ch-copy"},
+	}
+	for n, tt := range own {
+		if r := hls.copyRung(tt.src); r == nil || !r.copied || r.groupID() != tt.group || r.channels() != hls.track(tt.src).Channels {
+			t.Errorf("test %d: expected own group %s, got %v", n, tt.group, r)
+		}
+	}
+
+	// default ladder: E-AC-3 and 5.1 AAC sources are copied next to the AAC
+	// stereo rendition
+	hls.audioRungs = defaultAudioLadder()
+	for _, src := range []*ffprobe.Stream{
+		{Index: 3, CodecName: "eac3", SampleRate: 48000},
+		{Index: 3, CodecName: "aac", Profile: "LC", SampleRate: 48000},
+	} {
+		if r := hls.copyRung(src); r == nil || !r.copied || r.channels() != 6 {
+			t.Errorf("expected %s to be copied in its own group, got %v", src.CodecName, r)
+		}
+	}
+
+	// normalization requires transcoding
+	oldTarget := *loudnormTarget
+	t.Cleanup(func() { *loudnormTarget = oldTarget })
+	*loudnormTarget = -16
+	if r := hls.copyRung(tests[0].src); r != nil {
+		t.Errorf("expected transcoding with loudnorm, got %v", r)
+	}
+	*loudnormTarget = oldTarget
+
+	old := *forceAudioTranscode
+	t.Cleanup(func() { *forceAudioTranscode = old })
+	*forceAudioTranscode = true
+	if r := hls.copyRung(tests[0].src); r != nil {
+		t.Errorf("expected transcoding, got %v", r)
+	}
+}
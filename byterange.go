@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// byteRangeFile is the name of the packed file in byterange output
+const byteRangeFile = "media.hls"
+
+// buildByteRange writes playlists that reference media directly in the packed
+// file using byte ranges, so the output directory can be served by any http
+// server supporting Range requests. It must be called after buildPacked so
+// that positions of files are known.
+func (hls *hlsBuilder) buildByteRange(master *MasterPlaylist, playlists []*MediaPlaylist) error {
+	// byteRange returns the range within the packed file for fn, r being an
+	// existing range within fn if any
+	byteRange := func(fn string, r *ByteRange) (*ByteRange, error) {
+		nfo, ok := hls.files[fn]
+		if !ok {
+			return nil, fmt.Errorf("file %s missing from packed file", fn)
+		}
+		if r == nil {
+			return &ByteRange{Length: nfo.ln, Offset: nfo.pos}, nil
+		}
+		return &ByteRange{Length: r.Length, Offset: nfo.pos + r.Offset}, nil
+	}
+
+	names := make(map[string]string)
+	for n, uri := range master.Playlists() {
+		pl := playlists[n]
+
+		for _, s := range pl.Segments {
+			if s.Map != nil {
+				r, err := byteRange(s.Map.URI, s.Map.ByteRange)
+				if err != nil {
+					return err
+				}
+				s.Map.URI, s.Map.ByteRange = byteRangeFile, r
+			}
+			r, err := byteRange(s.URI, s.ByteRange)
+			if err != nil {
+				return err
+			}
+			s.URI, s.ByteRange = byteRangeFile, r
+		}
+
+		names[uri] = fmt.Sprintf("%d.m3u8", n)
+		if err := pl.SaveAs(filepath.Join(hls.out, names[uri])); err != nil {
+			return err
+		}
+	}
+	master.Rename(func(uri string) string { return names[uri] })
+
+	if hls.dash != nil {
+		buf, err := hls.dash.Bytes(func(fn string) (string, *fileInfo, error) {
+			nfo, ok := hls.files[fn]
+			if !ok {
+				return "", nil, fmt.Errorf("file %s missing from packed file", fn)
+			}
+			return byteRangeFile, nfo, nil
+		})
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(hls.out, dashManifest), buf, 0644); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("wrote %d byte range playlists to %s", len(playlists), hls.out)
+
+	return master.SaveAs(filepath.Join(hls.out, "master.m3u8"))
+}
+
+// parseByteRange parses a "<n>[@<o>]" byte range, off being used when o is
+// not specified
+func parseByteRange(r string, off int64) (int64, int64, error) {
+	lns, offs, hasOff := strings.Cut(r, "@")
+	ln, err := strconv.ParseInt(lns, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid byte range %s: %w", r, err)
+	}
+	if hasOff {
+		off, err = strconv.ParseInt(offs, 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid byte range %s: %w", r, err)
+		}
+	}
+	return ln, off, nil
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
 	"os"
 	"os/exec"
@@ -73,6 +74,29 @@ func (c Codec) String() string {
 	}
 }
 
+// defaultCRF returns the quality used by the crf rate control mode when not
+// specified
+func (c Codec) defaultCRF() int {
+	switch c {
+	case HEVC:
+		return 26
+	case AV1:
+		return 32
+	default:
+		return 23
+	}
+}
+
+// parseCodec returns the codec named name, as returned by Codec.String
+func parseCodec(name string) (Codec, error) {
+	for _, c := range []Codec{H264, HEVC, AV1} {
+		if c.String() == name {
+			return c, nil
+		}
+	}
+	return Copy, fmt.Errorf("unsupported codec %q", name)
+}
+
 func (c Codec) codecPreset(software bool) string {
 	if software {
 		if *fastEncode {
@@ -89,7 +113,8 @@ func (c Codec) codecPreset(software bool) string {
 	}
 }
 
-// idealBitsPerPixel returns a value for base bitrate, how good is it I don't know really
+// idealBitsPerPixel returns a value for base bitrate, use -quality to measure the
+// resulting quality of variants
 func (c Codec) idealBitsPerPixel() float64 {
 	switch c {
 	case H264:
@@ -104,18 +129,26 @@ func (c Codec) idealBitsPerPixel() float64 {
 	}
 }
 
-func (c Codec) Args(software bool, rate float64, s *vsize) CodecArgs {
-	bitrateInt := s.bitrate(rate, c.idealBitsPerPixel())
+func (c Codec) Args(software bool, rate float64, v *hlsVariant) CodecArgs {
+	r := v.settings()
+	mode := r.rateControl()
+	bitrateInt := v.bitrate(rate)
 	br := strconv.FormatUint(bitrateInt, 10)
 
+	// cap of vbr and crf modes
+	maxRate := v.maxRate(rate)
+	mr := strconv.FormatUint(maxRate, 10)
+	bufsize := strconv.FormatUint(maxRate*2, 10)
+	crf := strconv.Itoa(v.crf())
+
 	if c == Copy {
 		return CodecArgs{&codecArg{"-c", "copy"}}
 	}
 
 	if !software && *softFallback {
 		// fallback to software if this codec cannot be used
-		if err := c.testHardware(s); err != nil {
-			log.Printf("Using software encoding for codec %s / size %s as hardware encoding failed: %s", c, s, err)
+		if err := c.testHardware(v.size); err != nil {
+			log.Printf("Using software encoding for codec %s / size %s as hardware encoding failed: %s", c, v.size, err)
 			software = true
 		}
 	}
@@ -128,60 +161,123 @@ func (c Codec) Args(software bool, rate float64, s *vsize) CodecArgs {
 			&codecArg{"-c", codec},
 			&codecArg{"-pix_fmt", "yuv420p"},
 			&codecArg{"-preset", c.codecPreset(software)},
-			&codecArg{"-b", br},
-			&codecArg{"-maxrate", br},
 		}
-		if prof, ok := codecProfile[codec]; ok {
+		switch mode {
+		case "crf":
+			res = append(res,
+				&codecArg{"-rc", "vbr"},
+				&codecArg{"-cq", crf},
+				&codecArg{"-b", "0"},
+				&codecArg{"-maxrate", mr},
+				&codecArg{"-bufsize", bufsize},
+			)
+		case "vbr":
+			res = append(res,
+				&codecArg{"-rc", "vbr"},
+				&codecArg{"-b", br},
+				&codecArg{"-maxrate", mr},
+				&codecArg{"-bufsize", bufsize},
+			)
+		default:
+			res = append(res, &codecArg{"-b", br}, &codecArg{"-maxrate", br})
+		}
+		if r.Profile != "" {
+			res = append(res, &codecArg{"-profile", r.Profile})
+		} else if prof, ok := codecProfile[codec]; ok {
 			res = append(res, &codecArg{"-profile", prof})
 		}
+		if r.Level != "" {
+			res = append(res, &codecArg{"-level", r.Level})
+		}
+		if r.GOP > 0 {
+			res = append(res, &codecArg{"-g", strconv.Itoa(r.GOP)})
+		}
 		if tag, ok := codecTags[codec]; ok {
 			res = append(res, &codecArg{"-tag", tag})
 		}
 		return res
 	}
 
-	switch c {
-	case H264:
-		// /pkg/main/media-video.ffmpeg.core/bin/ffmpeg -h encoder=libx264
-		res := CodecArgs{
-			&codecArg{"-c", "libx264"},
-			&codecArg{"-x264-params", "nal-hrd=cbr:force-cfr=1"},
+	// rate control of software encoders
+	var rc CodecArgs
+	switch mode {
+	case "crf":
+		if c == AV1 {
+			// constrained quality, libaom uses the bitrate as cap
+			rc = CodecArgs{&codecArg{"-crf", crf}, &codecArg{"-b", mr}}
+		} else {
+			rc = CodecArgs{&codecArg{"-crf", crf}, &codecArg{"-maxrate", mr}, &codecArg{"-bufsize", bufsize}}
+		}
+	case "vbr":
+		rc = CodecArgs{
+			&codecArg{"-b", br},
+			&codecArg{"-maxrate", mr},
+			&codecArg{"-bufsize", bufsize},
+		}
+	default:
+		rc = CodecArgs{
 			&codecArg{"-b", br},
 			&codecArg{"-maxrate", br},
 			&codecArg{"-minrate", br},
 			&codecArg{"-bufsize", strconv.FormatUint(bitrateInt*2, 10)},
+		}
+	}
+
+	var res CodecArgs
+	switch c {
+	case H264:
+		// /pkg/main/media-video.ffmpeg.core/bin/ffmpeg -h encoder=libx264
+		params := "nal-hrd=vbr:force-cfr=1"
+		if mode == "cbr" {
+			params = "nal-hrd=cbr:force-cfr=1"
+		}
+		gop := "48"
+		if r.GOP > 0 {
+			gop = strconv.Itoa(r.GOP)
+		}
+		res = CodecArgs{
+			&codecArg{"-c", "libx264"},
+			&codecArg{"-x264-params", params},
+		}
+		res = append(res, rc...)
+		res = append(res,
 			&codecArg{"-preset", c.codecPreset(software)},
-			&codecArg{"-g", "48"},
+			&codecArg{"-g", gop},
 			&codecArg{"-sc_threshold", "0"},
-			&codecArg{"-keyint_min", "48"},
+			&codecArg{"-keyint_min", gop},
+		)
+		if r.Level != "" {
+			res = append(res, &codecArg{"-level", r.Level})
 		}
-		return res
 	case HEVC:
 		// /pkg/main/media-video.ffmpeg.core/bin/ffmpeg -h encoder=libx265
-		res := CodecArgs{
-			&codecArg{"-c", "libx265"},
-			&codecArg{"-b", br},
-			&codecArg{"-maxrate", br},
-			&codecArg{"-minrate", br},
-			&codecArg{"-bufsize", strconv.FormatUint(bitrateInt*2, 10)},
+		res = CodecArgs{&codecArg{"-c", "libx265"}}
+		res = append(res, rc...)
+		res = append(res,
 			&codecArg{"-tag", "hvc1"},
 			&codecArg{"-preset", c.codecPreset(software)},
+		)
+		if r.Level != "" {
+			res = append(res, &codecArg{"-x265-params", "level-idc=" + r.Level})
+		}
+		if r.GOP > 0 {
+			res = append(res, &codecArg{"-g", strconv.Itoa(r.GOP)})
 		}
-		return res
 	case AV1:
 		// /pkg/main/media-video.ffmpeg.core/bin/ffmpeg -h encoder=libaom-av1
-		res := CodecArgs{
-			&codecArg{"-c", "libaom-av1"},
-			&codecArg{"-b", br},
-			&codecArg{"-maxrate", br},
-			&codecArg{"-minrate", br},
-			&codecArg{"-bufsize", strconv.FormatUint(bitrateInt*2, 10)},
-			&codecArg{"-preset", c.codecPreset(software)},
+		res = CodecArgs{&codecArg{"-c", "libaom-av1"}}
+		res = append(res, rc...)
+		res = append(res, &codecArg{"-preset", c.codecPreset(software)})
+		if r.GOP > 0 {
+			res = append(res, &codecArg{"-g", strconv.Itoa(r.GOP)})
 		}
-		return res
 	default:
 		return nil
 	}
+	if r.Profile != "" {
+		res = append(res, &codecArg{"-profile", r.Profile})
+	}
+	return res
 }
 
 func (codec Codec) testHardware(size *vsize) error {
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"slices"
+	"strings"
+)
+
+var (
+	writeDASH = flag.Bool("dash", false, "also generate a MPEG-DASH manifest referencing the same fMP4 segments")
+)
+
+// dashManifest is the name of the manifest in dir and byterange outputs
+const dashManifest = "manifest.mpd"
+
+type mpd struct {
+	XMLName                   xml.Name     `xml:"urn:mpeg:dash:schema:mpd:2011 MPD"`
+	Profiles                  string       `xml:"profiles,attr"`
+	Type                      string       `xml:"type,attr"`
+	MediaPresentationDuration string       `xml:"mediaPresentationDuration,attr"`
+	MinBufferTime             string       `xml:"minBufferTime,attr"`
+	Periods                   []*mpdPeriod `xml:"Period"`
+}
+
+type mpdPeriod struct {
+	ID             string              `xml:"id,attr"`
+	Start          string              `xml:"start,attr"`
+	AdaptationSets []*mpdAdaptationSet `xml:"AdaptationSet"`
+}
+
+type mpdAdaptationSet struct {
+	ID               int                  `xml:"id,attr"`
+	ContentType      string               `xml:"contentType,attr"`
+	MimeType         string               `xml:"mimeType,attr"`
+	Lang             string               `xml:"lang,attr,omitempty"`
+	SegmentAlignment bool                 `xml:"segmentAlignment,attr,omitempty"`
+	StartWithSAP     int                  `xml:"startWithSAP,attr,omitempty"`
+	Role             *mpdDescriptor       `xml:"Role,omitempty"`
+	Representations  []*mpdRepresentation `xml:"Representation"`
+}
+
+type mpdDescriptor struct {
+	SchemeIDURI string `xml:"schemeIdUri,attr"`
+	Value       string `xml:"value,attr"`
+}
+
+type mpdRepresentation struct {
+	ID                        string          `xml:"id,attr"`
+	Bandwidth                 uint64          `xml:"bandwidth,attr"`
+	Codecs                    string          `xml:"codecs,attr,omitempty"`
+	Width                     int             `xml:"width,attr,omitempty"`
+	Height                    int             `xml:"height,attr,omitempty"`
+	FrameRate                 string          `xml:"frameRate,attr,omitempty"`
+	AudioChannelConfiguration *mpdDescriptor  `xml:"AudioChannelConfiguration,omitempty"`
+	BaseURL                   *mpdURL         `xml:"BaseURL,omitempty"` // whole file, for subtitles
+	SegmentList               *mpdSegmentList `xml:"SegmentList,omitempty"`
+}
+
+type mpdSegmentList struct {
+	Timescale      int       `xml:"timescale,attr"`
+	Initialization *mpdURL   `xml:"Initialization,omitempty"`
+	Timeline       []*mpdS   `xml:"SegmentTimeline>S"`
+	URLs           []*mpdURL `xml:"SegmentURL"`
+}
+
+type mpdS struct {
+	T *uint64 `xml:"t,attr"`
+	D uint64  `xml:"d,attr"`
+}
+
+// mpdURL references a work file. Its attributes are set on a copy by
+// mpd.Bytes depending on where the file ends up in the output.
+type mpdURL struct {
+	Text       string `xml:",chardata"` // BaseURL
+	SourceURL  string `xml:"sourceURL,attr,omitempty"`
+	Range      string `xml:"range,attr,omitempty"`
+	Media      string `xml:"media,attr,omitempty"`
+	MediaRange string `xml:"mediaRange,attr,omitempty"`
+
+	file string
+	off  int64 // for files referenced with EXT-X-BYTERANGE
+	ln   int64 // 0 for the whole file
+	kind byte  // 'b' for BaseURL, 'i' for Initialization, 's' for SegmentURL
+}
+
+// buildMPD returns a DASH manifest for the fMP4 streams and subtitles in the
+// given master and media playlists, which must still reference work files
+func (hls *hlsBuilder) buildMPD(master *MasterPlaylist, playlists []*MediaPlaylist) (*mpd, error) {
+	period := &mpdPeriod{ID: "0", Start: "PT0S"}
+	videoSets := make(map[string]*mpdAdaptationSet) // codec family → set
+	audioSets := make(map[string]*mpdAdaptationSet) // source track, codec family and channels → set
+	var duration, maxSegment float64
+
+	addSet := func(as *mpdAdaptationSet) {
+		period.AdaptationSets = append(period.AdaptationSets, as)
+	}
+
+	// I-frame playlists are not needed in DASH
+	var uris []string
+	for _, r := range master.Renditions {
+		if r.URI != "" {
+			uris = append(uris, r.URI)
+		}
+	}
+	for _, v := range master.Variants {
+		// variants are listed once per audio group
+		if !slices.Contains(uris, v.URI) {
+			uris = append(uris, v.URI)
+		}
+	}
+	byURI := make(map[string]*MediaPlaylist)
+	for n, uri := range master.Playlists() {
+		byURI[uri] = playlists[n]
+	}
+
+	for _, uri := range uris {
+		pl := byURI[uri]
+		ts, _ := hls.streamOf(uri)
+		if ts == nil {
+			continue
+		}
+
+		bw, _, err := hls.segmentsBandwidth(pl)
+		if err != nil {
+			return nil, err
+		}
+
+		if ts.typ == SubsStream {
+			if len(pl.Segments) != 1 {
+				continue
+			}
+			as := &mpdAdaptationSet{
+				ContentType: "text",
+				MimeType:    "text/vtt",
+				Lang:        ts.Language(),
+				Role:        &mpdDescriptor{SchemeIDURI: "urn:mpeg:dash:role:2011", Value: "subtitle"},
+			}
+			as.Representations = append(as.Representations, &mpdRepresentation{
+				ID:        fmt.Sprintf("stream_%d", ts.id),
+				Bandwidth: bw,
+				BaseURL:   &mpdURL{file: pl.Segments[0].URI, kind: 'b'},
+			})
+			addSet(as)
+			continue
+		}
+
+		list := mpdSegments(pl)
+		if list == nil {
+			// not fMP4, such as MPEG-TS variants
+			continue
+		}
+
+		for _, seg := range pl.Segments {
+			maxSegment = max(maxSegment, seg.Duration)
+		}
+		duration = max(duration, pl.Duration())
+
+		ps, mf, err := hls.probeStream(ts)
+		if err != nil {
+			return nil, err
+		}
+		mf.Close()
+
+		rep := &mpdRepresentation{
+			ID:          fmt.Sprintf("stream_%d", ts.id),
+			Bandwidth:   bw,
+			Codecs:      ps.codec,
+			SegmentList: list,
+		}
+
+		switch ts.typ {
+		case VideoStream:
+			rep.Width, rep.Height = ps.width, ps.height
+			rep.FrameRate = mpdFrameRate(ps.frameRate)
+			family, _, _ := strings.Cut(ps.codec, ".")
+			as, ok := videoSets[family]
+			if !ok {
+				as = &mpdAdaptationSet{ContentType: "video", MimeType: "video/mp4", SegmentAlignment: true, StartWithSAP: 1}
+				videoSets[family] = as
+				addSet(as)
+			}
+			as.Representations = append(as.Representations, rep)
+		case AudioStream:
+			if ps.channels > 0 {
+				rep.AudioChannelConfiguration = &mpdDescriptor{
+					SchemeIDURI: "urn:mpeg:dash:23003:3:audio_channel_configuration:2011",
+					Value:       fmt.Sprintf("%d", ps.channels),
+				}
+			}
+			// bitrates of the same track and codec can be switched
+			family, _, _ := strings.Cut(ps.codec, ".")
+			key := fmt.Sprintf("%d/%s/%d", ts.src.Index, family, ps.channels)
+			as, ok := audioSets[key]
+			if !ok {
+				as = &mpdAdaptationSet{ContentType: "audio", MimeType: "audio/mp4", Lang: ts.Language(), SegmentAlignment: true, StartWithSAP: 1}
+				audioSets[key] = as
+				addSet(as)
+			}
+			as.Representations = append(as.Representations, rep)
+		}
+	}
+
+	if len(videoSets) == 0 {
+		return nil, fmt.Errorf("no fMP4 video stream available for DASH output")
+	}
+
+	// video first, then audio and text
+	rank := map[string]int{"video": 0, "audio": 1, "text": 2}
+	slices.SortStableFunc(period.AdaptationSets, func(a, b *mpdAdaptationSet) int {
+		return rank[a.ContentType] - rank[b.ContentType]
+	})
+	for n, as := range period.AdaptationSets {
+		as.ID = n
+	}
+
+	return &mpd{
+		Profiles:                  "urn:mpeg:dash:profile:isoff-main:2011",
+		Type:                      "static",
+		MediaPresentationDuration: mpdDuration(duration),
+		MinBufferTime:             mpdDuration(math.Ceil(maxSegment)),
+		Periods:                   []*mpdPeriod{period},
+	}, nil
+}
+
+// mpdSegments returns the segment list of the fMP4 playlist pl, or nil if
+// pl is not a fMP4 playlist with a single initialization section
+func mpdSegments(pl *MediaPlaylist) *mpdSegmentList {
+	maps := pl.Maps()
+	if len(maps) != 1 || pl.Segments[0].Map == nil {
+		return nil
+	}
+
+	list := &mpdSegmentList{Timescale: 1000}
+	list.Initialization = mpdRef(maps[0].URI, maps[0].ByteRange, 'i')
+
+	var t uint64
+	for n, seg := range pl.Segments {
+		list.URLs = append(list.URLs, mpdRef(seg.URI, seg.ByteRange, 's'))
+
+		// round segment boundaries rather than durations to avoid drift
+		end := uint64(math.Round((float64(t)/1000 + seg.Duration) * 1000))
+		s := &mpdS{D: end - t}
+		if n == 0 {
+			s.T = new(uint64)
+		}
+		list.Timeline = append(list.Timeline, s)
+		t = end
+	}
+	return list
+}
+
+// mpdRef returns a reference to work file fn, or the range r within it
+func mpdRef(fn string, r *ByteRange, kind byte) *mpdURL {
+	u := &mpdURL{file: fn, kind: kind}
+	if r != nil {
+		u.off, u.ln = r.Offset, r.Length
+	}
+	return u
+}
+
+// Bytes returns the manifest with file references resolved by loc, which
+// returns the name of a work file in the output and, for byte range
+// outputs, its position within that file. m is not modified, so it can be
+// written for several outputs.
+func (m *mpd) Bytes(loc func(fn string) (string, *fileInfo, error)) ([]byte, error) {
+	res := *m
+	res.Periods = nil
+
+	for _, p := range m.Periods {
+		np := *p
+		np.AdaptationSets = nil
+
+		for _, as := range p.AdaptationSets {
+			nas := *as
+			nas.Representations = nil
+
+		reps:
+			for _, rep := range as.Representations {
+				nrep := *rep
+				var urls []**mpdURL
+				if rep.BaseURL != nil {
+					urls = append(urls, &nrep.BaseURL)
+				}
+				if rep.SegmentList != nil {
+					list := *rep.SegmentList
+					list.URLs = slices.Clone(list.URLs)
+					nrep.SegmentList = &list
+					urls = append(urls, &list.Initialization)
+					for n := range list.URLs {
+						urls = append(urls, &list.URLs[n])
+					}
+				}
+				for _, u := range urls {
+					name, nfo, err := loc((*u).file)
+					if err != nil {
+						return nil, err
+					}
+					nu, ok := (*u).resolve(name, nfo)
+					if !ok {
+						log.Printf("dash: skipping %s, %s cannot be referenced with a byte range", rep.ID, (*u).file)
+						continue reps
+					}
+					*u = nu
+				}
+				nas.Representations = append(nas.Representations, &nrep)
+			}
+			if len(nas.Representations) > 0 {
+				np.AdaptationSets = append(np.AdaptationSets, &nas)
+			}
+		}
+		res.Periods = append(res.Periods, &np)
+	}
+
+	buf, err := xml.MarshalIndent(&res, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), append(buf, '\n')...), nil
+}
+
+// resolve returns a copy of u with its attributes set for a reference to
+// name, at the position of nfo if not nil. Returns false if u cannot be
+// referenced this way.
+func (u *mpdURL) resolve(name string, nfo *fileInfo) (*mpdURL, bool) {
+	res := *u
+	var r string
+	if nfo != nil {
+		ln := u.ln
+		if ln == 0 {
+			ln = nfo.ln
+		}
+		r = fmt.Sprintf("%d-%d", nfo.pos+u.off, nfo.pos+u.off+ln-1)
+	} else if u.ln != 0 {
+		r = fmt.Sprintf("%d-%d", u.off, u.off+u.ln-1)
+	}
+
+	switch u.kind {
+	case 'b':
+		if r != "" {
+			return nil, false
+		}
+		res.Text = name
+	case 'i':
+		res.SourceURL, res.Range = name, r
+	default:
+		res.Media, res.MediaRange = name, r
+	}
+	return &res, true
+}
+
+// mpdDuration formats d seconds as a xs:duration
+func mpdDuration(d float64) string {
+	return fmt.Sprintf("PT%.3fS", d)
+}
+
+// mpdFrameRate formats a frame rate, using a fraction for NTSC rates
+func mpdFrameRate(rate float64) string {
+	if n := math.Round(rate * 1.001); math.Abs(rate-math.Round(rate)) > 0.001 && math.Abs(rate*1.001-n) < 0.01 {
+		return fmt.Sprintf("%d/1001", int(n*1000))
+	}
+	return fmt.Sprintf("%g", math.Round(rate*1000)/1000)
+}
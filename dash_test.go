@@ -0,0 +1,45 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMPDBytes(t *testing.T) {
+	list := &mpdSegmentList{
+		Timescale:      1000,
+		Initialization: mpdRef("stream_0_init.mp4", nil, 'i'),
+		URLs:           []*mpdURL{mpdRef("stream_0.mp4", &ByteRange{Length: 100, Offset: 50}, 's')},
+	}
+	m := &mpd{Periods: []*mpdPeriod{{AdaptationSets: []*mpdAdaptationSet{
+		{ContentType: "video", Representations: []*mpdRepresentation{{ID: "stream_0", SegmentList: list}}},
+		{ContentType: "text", Representations: []*mpdRepresentation{{ID: "stream_1", BaseURL: &mpdURL{file: "stream_1.vtt", kind: 'b'}}}},
+	}}}}
+
+	// byte range output, where subtitles cannot be referenced
+	buf, err := m.Bytes(func(fn string) (string, *fileInfo, error) {
+		return "video.hls", &fileInfo{pos: 1000, ln: 500}, nil
+	})
+	if err != nil {
+		t.Fatalf("failed to write: %s", err)
+	}
+	out := string(buf)
+	if !strings.Contains(out, `<Initialization sourceURL="video.hls" range="1000-1499">`) || !strings.Contains(out, `<SegmentURL media="video.hls" mediaRange="1050-1149">`) || strings.Contains(out, "text") {
+		t.Errorf("unexpected byte range manifest:\n%s", out)
+	}
+
+	// the manifest is unchanged and can be written again
+	if list.URLs[0].Media != "" || m.Periods[0].AdaptationSets[0].Representations[0].SegmentList != list {
+		t.Errorf("manifest was modified")
+	}
+	buf, err = m.Bytes(func(fn string) (string, *fileInfo, error) {
+		return "media/" + fn, nil, nil
+	})
+	if err != nil {
+		t.Fatalf("failed to write: %s", err)
+	}
+	out = string(buf)
+	if !strings.Contains(out, `<Initialization sourceURL="media/stream_0_init.mp4">`) || !strings.Contains(out, `<SegmentURL media="media/stream_0.mp4" mediaRange="50-149">`) || !strings.Contains(out, "<BaseURL>media/stream_1.vtt</BaseURL>") {
+		t.Errorf("unexpected manifest:\n%s", out)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// buildDir writes all files in a plain directory, with one sub directory per
+// stream holding its playlists and media files:
+//
+//	master.m3u8
+//	video_1920x1080_hevc/playlist.m3u8
+//	video_1920x1080_hevc/init.mp4
+//	video_1920x1080_hevc/segment_1.m4s
+//	audio_0_jpn/playlist.m3u8
+//	...
+func (hls *hlsBuilder) buildDir(master *MasterPlaylist, playlists []*MediaPlaylist) error {
+	names := make(map[string]string) // work file → output name
+	used := make(map[string]bool)
+	copied := make(map[string]bool)
+
+	name := func(fn string) string {
+		if res, ok := names[fn]; ok {
+			return res
+		}
+		res := hls.dirName(fn)
+		for n := 2; used[res]; n++ {
+			// should not happen, but make sure we do not overwrite anything
+			ext := path.Ext(res)
+			res = fmt.Sprintf("%s_%d%s", strings.TrimSuffix(res, ext), n, ext)
+		}
+		names[fn] = res
+		used[res] = true
+		return res
+	}
+
+	// media files may be referenced from multiple playlists
+	copyFile := func(fn string) error {
+		if copied[fn] {
+			return nil
+		}
+		copied[fn] = true
+		return hls.copyFile(fn, name(fn))
+	}
+
+	// copy media files first
+	uris := master.Playlists()
+	for n, uri := range uris {
+		pl := playlists[n]
+		plName := name(uri)
+
+		for _, s := range pl.Segments {
+			if s.Map != nil {
+				if err := copyFile(s.Map.URI); err != nil {
+					return err
+				}
+				s.Map.URI = relName(plName, name(s.Map.URI))
+			}
+			if err := copyFile(s.URI); err != nil {
+				return err
+			}
+			s.URI = relName(plName, name(s.URI))
+		}
+	}
+	master.Rename(name)
+
+	for n, uri := range uris {
+		buf, err := playlists[n].Bytes()
+		if err != nil {
+			return err
+		}
+		if err := hls.writeOut(name(uri), buf); err != nil {
+			return err
+		}
+	}
+
+	if hls.dash != nil {
+		buf, err := hls.dash.Bytes(func(fn string) (string, *fileInfo, error) {
+			if !copied[fn] {
+				return "", nil, fmt.Errorf("file %s missing from output", fn)
+			}
+			return relName(dashManifest, name(fn)), nil, nil
+		})
+		if err != nil {
+			return err
+		}
+		if err := hls.writeOut(dashManifest, buf); err != nil {
+			return err
+		}
+	}
+
+	if metadataEnabled() {
+		buf, err := json.MarshalIndent(hls.metadata(), "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := hls.writeOut("metadata.json", buf); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("wrote %d playlists and %d media files to %s", len(playlists), len(copied), hls.out)
+
+	buf, err := master.Bytes()
+	if err != nil {
+		return err
+	}
+	return hls.writeOut("master.m3u8", buf)
+}
+
+// dirName returns the name a work file has in the output directory
+func (hls *hlsBuilder) dirName(fn string) string {
+	s, rest := hls.streamOf(fn)
+	if s == nil {
+		return path.Base(fn)
+	}
+
+	ext := path.Ext(rest)
+	rest = strings.TrimPrefix(strings.TrimSuffix(rest, ext), "_")
+	switch {
+	case ext == ".m3u8" && (rest == "" || rest == "sub"):
+		rest = "playlist"
+	case rest == "":
+		rest = "stream"
+	case rest[0] >= '0' && rest[0] <= '9':
+		rest = "segment_" + rest
+	}
+
+	return hls.label(s) + "/" + rest + ext
+}
+
+// relName returns target relative to the directory of the playlist pl
+func relName(pl, target string) string {
+	if path.Dir(pl) == path.Dir(target) {
+		return path.Base(target)
+	}
+	res, err := filepath.Rel(path.Dir(pl), target)
+	if err != nil {
+		return target
+	}
+	return filepath.ToSlash(res)
+}
+
+// copyFile copies work file fn to the output directory
+func (hls *hlsBuilder) copyFile(fn, name string) error {
+	out := filepath.Join(hls.out, filepath.FromSlash(name))
+
+	in, err := os.Open(filepath.Join(hls.dir, fn))
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	if err := os.MkdirAll(filepath.Dir(out), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, in); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// writeOut writes buf as name in the output directory
+func (hls *hlsBuilder) writeOut(name string, buf []byte) error {
+	out := filepath.Join(hls.out, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(out), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(out, buf, 0644)
+}
@@ -4,9 +4,11 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"math"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 
@@ -75,6 +77,14 @@ func (hls *hlsBuilder) prepareVideo(input string) error {
 	}
 	hls.subtitles = usableSubs
 
+	ladder, err := loadLadder()
+	if err != nil {
+		return err
+	}
+	if err := hls.prepareAudio(ladder); err != nil {
+		return err
+	}
+
 	siz := &vsize{w: hls.video.Width, h: hls.video.Height}
 
 	// generate variant sizes
@@ -85,12 +95,19 @@ func (hls *hlsBuilder) prepareVideo(input string) error {
 		log.Printf("will be generating the following sizes (single mode enabled): %v", hls.variants)
 		return nil
 	}
-	hls.variants = append(hls.variants, siz.variants()...)
-	for siz = siz.smaller(); siz != nil; siz = siz.smaller() {
-		if len(hls.variants) >= *maxStreams {
-			break
+	hls.variants = ladder.variants(siz)
+	if len(hls.variants) == 0 {
+		return fmt.Errorf("ladder has no rung for source size %s", siz)
+	}
+
+	if *perTitle {
+		nfo, err := hls.probeComplexity()
+		if err != nil {
+			return err
 		}
-		hls.variants = append(hls.variants, siz.variants()...)
+		log.Printf("per-title: source complexity %.4f bits per pixel, bitrate factor %.2f", nfo.BitsPerPixel, nfo.Factor)
+		hls.applyComplexity(nfo)
+		hls.complexity = nfo
 	}
 
 	log.Printf("will be generating the following sizes: %v", hls.variants)
@@ -98,63 +115,49 @@ func (hls *hlsBuilder) prepareVideo(input string) error {
 }
 
 func (hls *hlsBuilder) encodeVideo() error {
-	// prepare the command line
-	args := []string{"-hide_banner", "-y"}
-
 	// reset stuff
 	hls.streams = nil
 
-	if !*verboseMode {
-		args = append(args, "-loglevel", "warning")
-	}
-	if !*softwareMode {
-		args = append(args, "-hwaccel", "auto")
-	}
-
-	args = append(args, "-i", hls.input)
-
 	softwareEncode := *softwareMode
 
-	// prepare filter_complex
-	var flt string
-	if videoFilters != nil && *videoFilters != "" {
-		flt = fmt.Sprintf("[v:0]%s,split=%d", *videoFilters, len(hls.variants))
-	} else {
-		flt = fmt.Sprintf("[v:0]split=%d", len(hls.variants))
-	}
-	for n := range hls.variants {
-		if n == 0 {
-			flt += "[v0]"
-			continue
+	// prepare codec settings and the analysis pass, if any
+	rate := hls.frameRate()
+	codecArgs := make([]CodecArgs, len(hls.variants))
+	var analysed []int
+	for n, v := range hls.variants {
+		codecArgs[n] = v.codec.Args(softwareEncode, rate, v)
+		if *twoPass && codecArgs[n].twoPassCapable() && v.settings().rateControl() != "crf" {
+			analysed = append(analysed, n)
 		}
-		flt += fmt.Sprintf("[vin%d]", n)
 	}
-	for n, s := range hls.variants {
-		if n == 0 {
-			// n==0 means original size
-			continue
+	if len(analysed) > 0 {
+		if err := hls.analysisPass(codecArgs, analysed); err != nil {
+			return err
 		}
-		flt += fmt.Sprintf(";[vin%d]%s[v%d]", n, s.size.Scale(), n)
 	}
-	args = append(args, "-filter_complex", flt)
-
-	// map filters
-	rate := hls.video.FrameRate.Value()
 
-	// force good framerate values
-	if rate > 60 {
-		rate = 60
-	} else if rate < 10 {
-		rate = 10
+	// first loudnorm pass
+	if *loudnormTarget != 0 {
+		if err := hls.measureLoudness(); err != nil {
+			return err
+		}
 	}
 
-	for n, v := range hls.variants {
-		codec := v.codec
+	// prepare the command line
+	args := hls.inputArgs()
+	args = append(args, "-filter_complex", hls.filterComplex(hls.variants))
+
+	// map filters
+	for n := range hls.variants {
 		ns := strconv.Itoa(n)
 		ts := hls.newStream(hls.video)
 
+		vargs := codecArgs[n]
+		if slices.Contains(analysed, n) {
+			vargs = vargs.withPass(2, passLogFile(n))
+		}
 		args = append(args, "-map", "[v"+ns+"]")
-		args = append(args, codec.Args(softwareEncode, rate, v.size).Expand()...)
+		args = append(args, vargs.Expand()...)
 
 		args = append(args, ts.Filename())
 	}
@@ -162,14 +165,27 @@ func (hls *hlsBuilder) encodeVideo() error {
 	// audio
 	for n, audio := range hls.audios {
 		ns := strconv.Itoa(n)
-		ts := hls.newStream(audio)
-		args = append(args,
-			"-map", "a:"+ns,
-			"-c", "aac",
-			"-b:a", "96k",
-			"-ac", "2",
-		)
-		args = append(args, ts.Filename())
+		cp := hls.copyRung(audio)
+		rungs := hls.audioRungsFor(audio)
+		if cp != nil && cp.copied {
+			rungs = append(rungs, cp)
+		}
+		for _, r := range rungs {
+			ts := hls.newStream(audio)
+			ts.audio = r
+			args = append(args, "-map", "a:"+ns)
+			if r == cp {
+				log.Printf("audio: copying track #%d as %s", audio.Index, r.groupID())
+				ts.passthrough = true
+				args = append(args, "-c:a", "copy")
+			} else {
+				if nfo := hls.loudness[loudnessKey{index: audio.Index, channels: r.channels()}]; nfo != nil {
+					args = append(args, "-af", loudnormFilter(nfo, audio, r.channels()))
+				}
+				args = append(args, r.args()...)
+			}
+			args = append(args, ts.Filename())
+		}
 	}
 
 	if *verboseMode {
@@ -256,6 +272,63 @@ func (hls *hlsBuilder) encodeVideo() error {
 	return nil
 }
 
+// inputArgs returns the ffmpeg arguments up to the input file
+func (hls *hlsBuilder) inputArgs() []string {
+	args := []string{"-hide_banner", "-y"}
+
+	if !*verboseMode {
+		args = append(args, "-loglevel", "warning")
+	}
+	if !*softwareMode {
+		args = append(args, "-hwaccel", "auto")
+	}
+
+	return append(args, "-i", hls.input)
+}
+
+// filterComplex returns the filter graph splitting the source video into the
+// given variants, variants[n] being labeled [v<n>]
+func (hls *hlsBuilder) filterComplex(variants []*hlsVariant) string {
+	var flt string
+	if videoFilters != nil && *videoFilters != "" {
+		flt = fmt.Sprintf("[v:0]%s,split=%d", *videoFilters, len(variants))
+	} else {
+		flt = fmt.Sprintf("[v:0]split=%d", len(variants))
+	}
+	src := vsize{w: hls.video.Width, h: hls.video.Height}
+	for n, v := range variants {
+		if *v.size == src {
+			// original size
+			flt += fmt.Sprintf("[v%d]", n)
+			continue
+		}
+		flt += fmt.Sprintf("[vin%d]", n)
+	}
+	for n, v := range variants {
+		if *v.size == src {
+			continue
+		}
+		flt += fmt.Sprintf(";[vin%d]%s[v%d]", n, v.size.Scale(), n)
+	}
+	return flt
+}
+
+// frameRate returns the source framerate, clamped to usable values
+func (hls *hlsBuilder) frameRate() float64 {
+	rate := hls.video.FrameRate.Value()
+
+	// force good framerate values
+	if math.IsNaN(rate) {
+		// unknown framerate
+		rate = 30
+	} else if rate > 60 {
+		rate = 60
+	} else if rate < 10 {
+		rate = 10
+	}
+	return rate
+}
+
 func (hls *hlsBuilder) makeSubPlaylist(ts *hlsStream) error {
 	s := ts.src
 
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"bytes"
 	"flag"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"strings"
 )
 
 var (
@@ -38,3 +41,20 @@ func exe(n string) string {
 	// by default exec will perform path lookup, so just return n
 	return n
 }
+
+// ffmpegHas returns true if name is in the given ffmpeg list, such as
+// "filters" or "encoders"
+func ffmpegHas(list, name string) bool {
+	out, err := exec.Command(exe("ffmpeg"), "-hide_banner", "-"+list).Output()
+	if err != nil {
+		return false
+	}
+	for _, ln := range bytes.Split(out, []byte{'\n'}) {
+		// " A....D libopus              libopus Opus (codec opus)"
+		f := strings.Fields(string(ln))
+		if len(f) >= 2 && f[1] == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/KarpelesLab/hlsmaker/hlsfile"
+)
+
+// extractCommand unpacks a packed hls file into a directory that can be
+// served by any http server
+func extractCommand(args []string) error {
+	if len(args) != 2 {
+		return errors.New("usage: extract file.hls directory")
+	}
+
+	f, err := hlsfile.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dir := args[1]
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	// playlists already reference other entries by name, so writing each
+	// entry under its name is enough. The DASH manifest is not referenced and
+	// uses the name it is served as.
+	for _, e := range append([]*hlsfile.Entry{f.Master}, f.Entries...) {
+		name := e.Name()
+		if e.Type() == hlsfile.FileMPD {
+			name = "manifest.mpd"
+		}
+		if err := extractEntry(f, e, filepath.Join(dir, name)); err != nil {
+			return fmt.Errorf("while extracting %s: %w", name, err)
+		}
+	}
+
+	log.Printf("extract: wrote %d files to %s", len(f.Entries)+1, dir)
+	return nil
+}
+
+func extractEntry(f *hlsfile.File, e *hlsfile.Entry, fn string) error {
+	out, err := os.Create(fn)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	n, err := io.Copy(out, f.Reader(e))
+	if err != nil {
+		return err
+	}
+	if n != e.Length {
+		return hlsfile.ErrTruncated
+	}
+	return out.Close()
+}
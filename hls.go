@@ -2,75 +2,165 @@ package main
 
 import (
 	"encoding/binary"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"os"
-	"os/exec"
 	"path"
 	"path/filepath"
 	"time"
 
 	"github.com/KarpelesLab/ffprobe"
+	"github.com/KarpelesLab/hlsmaker/hlsfile"
 )
 
 // special hls format
 // All playlist will reference "data" for data, or <x>.m3u8 for streams with x starting at 0
 // master stream is stream -1 and is not addressed directly
 //
-// Header is 16 bytes:
+// Version 1 (default) header is 16 bytes:
 // HLS<v>
 // <4 bytes flags>
 // <4 bytes number of streams>
 // <4 bytes timestamp>
-// for master and each stream: <8 bytes offset of playlist> <4 bytes flags> <4 bytes file length>
+// for master and each stream: <8 bytes offset> <4 bytes flags> <4 bytes length>
 //
 // total size of header is 16 + 16 + (nstream * 16)
+//
+// Version 2 (-hls_version 2) header is 32 bytes:
+// HLS<v>
+// <4 bytes flags>
+// <4 bytes number of streams>
+// <4 bytes CRC32C of header and entry table, computed with this field set to zero>
+// <8 bytes timestamp>
+// <8 bytes reserved>
+// for master and each stream: <8 bytes offset> <8 bytes length> <4 bytes flags> <4 bytes CRC32C of data>
+//
+// total size of header is 32 + 24 + (nstream * 24)
+//
+// All values are big endian. See package hlsfile for reading these files.
 
 var (
-	keepTemp = flag.Bool("keeptemp", false, "keep temporary files")
+	keepTemp     = flag.Bool("keeptemp", false, "keep temporary files")
+	outputFormat = flag.String("format", "hls", "output format: hls (packed file), dir (plain directory) or byterange (packed file with byte range playlists)")
+	hlsVersion   = flag.Int("hls_version", 1, "packed file format version, 2 adds checksums and supports files over 4GB")
 )
 
 type fileInfo struct {
 	pos int64
 	ln  int64
+	sum uint32 // CRC32C
 }
 
 type hlsVariant struct {
 	size  *vsize
 	codec Codec
+	rung  *Rung // encoding settings, nil for defaults
+
+	quality *hlsfile.QualityInfo // if measured
 }
 
 func (v *hlsVariant) String() string {
 	return fmt.Sprintf("%s@%s", v.codec, v.size)
 }
 
+// settings returns the encoding settings of v
+func (v *hlsVariant) settings() *Rung {
+	if v.rung == nil {
+		return &Rung{codec: v.codec}
+	}
+	return v.rung
+}
+
+// bitrate returns the target bitrate of v at the given frame rate
+func (v *hlsVariant) bitrate(rate float64) uint64 {
+	r := v.settings()
+	if r.Bitrate > 0 {
+		return r.Bitrate
+	}
+	bpp := v.codec.idealBitsPerPixel()
+	if r.BitsPerPixel > 0 {
+		bpp = r.BitsPerPixel
+	}
+	return v.size.bitrate(rate, bpp)
+}
+
+// maxRate returns the bitrate cap of v in vbr and crf rate control modes,
+// 1.5 times the target bitrate by default
+func (v *hlsVariant) maxRate(rate float64) uint64 {
+	if r := v.settings(); r.MaxRate > 0 {
+		return r.MaxRate
+	}
+	return v.bitrate(rate) * 3 / 2
+}
+
+// crf returns the quality of v in crf rate control mode
+func (v *hlsVariant) crf() int {
+	if r := v.settings(); r.CRF > 0 {
+		return r.CRF
+	}
+	return v.codec.defaultCRF()
+}
+
 type hlsBuilder struct {
-	f       *os.File
+	f       *os.File // output file, only in hls and byterange formats
+	out     string
+	version byte
 	info    *ffprobe.File // source file info
 	dir     string
 	files   map[string]*fileInfo
 	streams []*hlsStream
 
+	packager   Packager
+	dash       *mpd                    // DASH manifest, if enabled
+	complexity *hlsfile.ComplexityInfo // per-title mode only
+
 	// vars used by encoding
 	input     string
 	variants  []*hlsVariant
 	video     *ffprobe.Stream
 	audios    []*ffprobe.Stream
 	subtitles []*ffprobe.Stream
-}
 
-const (
-	FilePlaylist = iota
-	FileMpegTS
-	FileMP4
-	FileVTT
-	FileM4S
-)
+	audioRungs []*AudioRung                          // audio renditions of each audio track
+	tracks     map[int]*audioTrack                   // probed audio tracks by source stream index
+	loudness   map[loudnessKey]*hlsfile.LoudnessInfo // nil if silent
+}
 
 func newHlsBuilder(out string) (*hlsBuilder, error) {
-	file, err := os.Create(out)
+	if *hlsVersion != 1 && *hlsVersion != 2 {
+		return nil, fmt.Errorf("unsupported hls_version %d", *hlsVersion)
+	}
+
+	var file *os.File
+	switch *outputFormat {
+	case "hls":
+		var err error
+		file, err = os.Create(out)
+		if err != nil {
+			return nil, err
+		}
+	case "dir":
+		if err := os.MkdirAll(out, 0755); err != nil {
+			return nil, err
+		}
+	case "byterange":
+		if err := os.MkdirAll(out, 0755); err != nil {
+			return nil, err
+		}
+		var err error
+		file, err = os.Create(filepath.Join(out, byteRangeFile))
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported output format %s", *outputFormat)
+	}
+
+	p, err := getPackager()
 	if err != nil {
 		return nil, err
 	}
@@ -82,48 +172,15 @@ func newHlsBuilder(out string) (*hlsBuilder, error) {
 	}
 	log.Printf("Using temporary dir: %s", d)
 
-	return &hlsBuilder{f: file, files: make(map[string]*fileInfo), dir: d}, nil
-}
-
-func (hls *hlsBuilder) makeHls() error {
-	// invoke shaka-packager
-	// https://shaka-project.github.io/shaka-packager/html/tutorials/hls.html#examples
-	cmd := []string{"/pkg/main/media-video.shaka-packager.core/bin/shaka-packager"}
-
-	// for each in
-	for _, ts := range hls.streams {
-		if ts.typ == SubsStream {
-			// shaka has trouble reading some of ffmpeg subtitles files, and really we don't care about splitting these most of the time
-			continue
-		}
-		arg := "in=" + ts.Filename() + ",stream=" + ts.Typename()
-
-		arg += fmt.Sprintf(",init_segment=stream_%d_init.mp4,segment_template=stream_%d_$Number$.m4s", ts.id, ts.id)
-		if ts.typ == VideoStream {
-			arg += fmt.Sprintf(",iframe_playlist_name=stream_%d_iframe.m3u8", ts.id)
-		}
-
-		cmd = append(cmd, arg)
-	}
-
-	cmd = append(cmd, "--hls_playlist_type", "VOD", "--hls_master_playlist_output", "master.m3u8")
-
-	log.Printf("About to run: %v", cmd)
-
-	c := exec.Command(cmd[0], cmd[1:]...)
-	c.Dir = hls.dir // set to run in temp dir
-	c.Stdout = os.Stdout
-	c.Stderr = os.Stderr
-
-	return c.Run()
+	return &hlsBuilder{f: file, out: out, version: byte(*hlsVersion), files: make(map[string]*fileInfo), dir: d, packager: p}, nil
 }
 
 func (hls *hlsBuilder) build() error {
-	if err := hls.makeHls(); err != nil {
+	if err := hls.packageStreams(); err != nil {
 		return fmt.Errorf("while making hls: %w", err)
 	}
 
-	master, err := m3u8Parse(filepath.Join(hls.dir, "master.m3u8"))
+	master, err := parseMaster(filepath.Join(hls.dir, "master.m3u8"))
 	if err != nil {
 		return err
 	}
@@ -142,135 +199,211 @@ func (hls *hlsBuilder) build() error {
 			return fmt.Errorf("while writing subs playlist: %w", err)
 		}
 
-		opts := []string{"TYPE=SUBTITLES", `GROUP-ID="subs"`, "DEFAULT=NO", "AUTOSELECT=YES", "FORCED=NO", "URI=\"" + pfn + "\""}
-		title := "subtitles"
+		// append to master
+		// #EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="subs",NAME="English subs",LANGUAGE="en",DEFAULT=NO,AUTOSELECT=YES,FORCED=NO,URI="4.m3u8"
+		r := master.AddRendition("SUBTITLES", "subs", "subtitles", pfn)
 		if lng, ok := ts.src.Tags["language"]; ok {
-			title = lng + " subs"
-			if len(lng) > 2 {
-				// TODO better map language
-				lng = lng[:2]
-			}
-			opts = append(opts, "LANGUAGE=\""+lng+"\"")
+			r.Name = lng + " subs"
+			r.Language = ts.Language()
 		}
 		if t, ok := ts.src.Tags["title"]; ok {
-			title = t
+			r.Name = t
 		}
-		opts = append(opts, "NAME=\""+title+"\"")
-
-		// append to master
-		// #EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="subs",NAME="English subs",LANGUAGE="en",DEFAULT=NO,AUTOSELECT=YES,FORCED=NO,URI="4.m3u8"
-		master.files = append(master.files, &m3u8file{
-			filename: pfn,
-			headers: []*m3u8spec{
-				&m3u8spec{key: "#EXT-X-MEDIA", vars: opts},
-			},
-		})
 		subcnt += 1
 	}
 	if subcnt > 0 {
 		// add subs to videos
-		for _, f := range master.files {
-			// only video streams are standalone
-			if f.standalone {
-				f.headers[0].set("SUBTITLES", `"subs"`)
-			}
+		for _, v := range master.Variants {
+			v.Subtitles = "subs"
 		}
 	}
 
-	var playlists []*m3u8
-	uniqueFiles := make(map[string]int)
+	// list each codec's ladder together
+	master.GroupByCodec()
+
+	// playlists[n] is the playlist for master.Playlists()[n]
+	var playlists []*MediaPlaylist
 
-	for n, f := range master.files {
-		pl, err := m3u8Parse(filepath.Join(hls.dir, f.filename))
+	for _, uri := range master.Playlists() {
+		pl, err := parseMedia(filepath.Join(hls.dir, uri))
 		if err != nil {
 			return err
 		}
 		playlists = append(playlists, pl)
-		for _, h := range pl.headers {
-			// check for #EXT-X-MAP:URI="init_0.mp4" header
-			if h.key == "#EXT-X-MAP" {
-				uniqueFiles[h.get("URI")] = 0
+	}
+
+	if err := hls.updateBandwidth(master, playlists); err != nil {
+		return fmt.Errorf("while measuring bandwidth: %w", err)
+	}
+
+	if *lintBuild {
+		if err := hls.lint(master, playlists); err != nil {
+			return err
+		}
+	}
+
+	if *writeDASH {
+		hls.dash, err = hls.buildMPD(master, playlists)
+		if err != nil {
+			return fmt.Errorf("while making dash manifest: %w", err)
+		}
+	}
+
+	switch *outputFormat {
+	case "dir":
+		return hls.buildDir(master, playlists)
+	case "byterange":
+		// buildPacked renames files in playlists, keep a copy
+		brMaster, err := master.clone()
+		if err != nil {
+			return err
+		}
+		var brPlaylists []*MediaPlaylist
+		for _, pl := range playlists {
+			c, err := pl.clone()
+			if err != nil {
+				return err
 			}
+			brPlaylists = append(brPlaylists, c)
 		}
-		f.setFilename(fmt.Sprintf("%d.m3u8", n))
-		for _, sub := range pl.files {
-			uniqueFiles[sub.filename] = 0
+		if err := hls.buildPacked(master, playlists); err != nil {
+			return err
+		}
+		return hls.buildByteRange(brMaster, brPlaylists)
+	default:
+		return hls.buildPacked(master, playlists)
+	}
+}
+
+// buildPacked writes all files in the packed hls format
+func (hls *hlsBuilder) buildPacked(master *MasterPlaylist, playlists []*MediaPlaylist) error {
+	uniqueFiles := make(map[string]int)
+
+	uris := master.Playlists()
+	for _, pl := range playlists {
+		for _, s := range pl.Segments {
+			if s.Map != nil {
+				uniqueFiles[s.Map.URI] = 0
+			}
+			uniqueFiles[s.URI] = 0
 		}
 	}
 	log.Printf("identified %d unique media files", len(uniqueFiles))
 
 	// clear output file
-	pos := int64(16 + 16 + (len(master.files)+len(uniqueFiles))*16)
-	hls.f.Truncate(0)
-	hls.f.Seek(pos, io.SeekStart)
+	entries := len(uris) + len(uniqueFiles)
+	if metadataEnabled() {
+		entries += 1
+	}
+	if hls.dash != nil {
+		entries += 1
+	}
+	pos := hlsfile.HeaderLen(hls.version, int64(entries))
+	if err := hls.f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := hls.f.Seek(pos, io.SeekStart); err != nil {
+		return err
+	}
+
+	cnt := len(uris) // 4
 
-	cnt := len(master.files) // 4
+	// entryName writes fn as a new entry if needed and returns its name
+	entryName := func(fn string) (string, error) {
+		n := uniqueFiles[fn]
+		if n == 0 {
+			nfo, err := hls.getFile(fn)
+			if err != nil {
+				return "", err
+			}
+			n = cnt
+			uniqueFiles[fn] = n
+			cnt += 1
+			if err := hls.writeEntry(n, nfo, hlsFlagsName(fn)); err != nil {
+				return "", err
+			}
+		}
+		return fmt.Sprintf("%d%s", n, path.Ext(fn)), nil
+	}
 
 	for _, pl := range playlists {
-		for _, h := range pl.headers {
-			// check for #EXT-X-MAP:URI="init_0.mp4" header
-			if h.key == "#EXT-X-MAP" {
-				// extract filename
-				fn := h.get("URI")
-				n := uniqueFiles[fn]
-				pos, ln, err := hls.getFile(fn)
-				if err != nil {
+		for _, s := range pl.Segments {
+			var err error
+			if s.Map != nil {
+				if s.Map.URI, err = entryName(s.Map.URI); err != nil {
 					return err
 				}
-				if n == 0 {
-					n = cnt
-					uniqueFiles[fn] = n
-					cnt += 1
-					hls.writeInt64(32+(16*n), uint64(pos))
-					hls.writeInt32(32+(16*n)+8, hlsFlagsName(fn))
-					hls.writeInt32(32+(16*n)+12, uint32(ln))
-				}
-				// overwrite header
-				fn = fmt.Sprintf("%d%s", n, path.Ext(fn))
-				h.set("URI", fmt.Sprintf("\"%s\"", fn))
 			}
-		}
-		for _, f := range pl.files {
-			n := uniqueFiles[f.filename]
-			pos, ln, err := hls.getFile(f.filename)
-			if err != nil {
+			if s.URI, err = entryName(s.URI); err != nil {
 				return err
 			}
-			if n == 0 {
-				n = cnt
-				uniqueFiles[f.filename] = n
-				cnt += 1
-				hls.writeInt64(32+(16*n), uint64(pos))
-				hls.writeInt32(32+(16*n)+8, hlsFlags(f))
-				hls.writeInt32(32+(16*n)+12, uint32(ln))
-			}
-			f.filename = fmt.Sprintf("%d%s", n, path.Ext(f.filename))
 		}
 	}
 
-	pos, err = hls.f.Seek(0, io.SeekCurrent)
-	if err != nil {
-		return err
+	index := make(map[string]int)
+	for n, uri := range uris {
+		index[uri] = n
 	}
-
-	var buf []byte
-	var ln int
+	master.Rename(func(uri string) string { return fmt.Sprintf("%d.m3u8", index[uri]) })
 
 	for n, pl := range playlists {
-		buf = pl.Bytes()
-		ln, err = hls.f.Write(buf)
+		buf, err := pl.Bytes()
+		if err != nil {
+			return err
+		}
+		nfo, err := hls.appendData(buf)
+		if err != nil {
+			return err
+		}
+		if err := hls.writeEntry(n, nfo, hlsfile.FilePlaylist); err != nil {
+			return err
+		}
+	}
+
+	var flags uint32
+	if hls.dash != nil {
+		buf, err := hls.dash.Bytes(func(fn string) (string, *fileInfo, error) {
+			n, ok := uniqueFiles[fn]
+			if !ok {
+				return "", nil, fmt.Errorf("file %s missing from packed file", fn)
+			}
+			return fmt.Sprintf("%d%s", n, path.Ext(fn)), nil, nil
+		})
+		if err != nil {
+			return err
+		}
+		nfo, err := hls.appendData(buf)
+		if err != nil {
+			return err
+		}
+		if err := hls.writeEntry(cnt, nfo, hlsfile.FileMPD); err != nil {
+			return err
+		}
+		cnt += 1
+		flags |= hlsfile.FlagDASH
+	}
+	if metadataEnabled() {
+		buf, err := json.Marshal(hls.metadata())
+		if err != nil {
+			return err
+		}
+		nfo, err := hls.appendData(buf)
 		if err != nil {
 			return err
 		}
-		hls.writeInt64(32+(16*n), uint64(pos))
-		// flags == 0
-		hls.writeInt32(32+(16*n)+12, uint32(ln))
-		pos += int64(ln)
+		if err := hls.writeEntry(cnt, nfo, hlsfile.FileMetadata); err != nil {
+			return err
+		}
+		cnt += 1
+		flags |= hlsfile.FlagMetadata
 	}
 
 	// write master at the end
-	buf = master.Bytes()
-	ln, err = hls.f.Write(buf)
+	buf, err := master.Bytes()
+	if err != nil {
+		return err
+	}
+	nfo, err := hls.appendData(buf)
 	if err != nil {
 		return err
 	}
@@ -279,56 +412,121 @@ func (hls *hlsBuilder) build() error {
 	os.WriteFile(filepath.Join(hls.dir, "master_fixed.m3u8"), buf, 0644)
 
 	// write info
-	hls.writeInt32(8, uint32(cnt))
-	hls.writeInt32(12, uint32(time.Now().Unix()))
-	hls.writeInt64(16, uint64(pos))
-	hls.writeInt32(28, uint32(ln))
-	pos += int64(ln)
+	if err := hls.writeEntry(-1, nfo, 0); err != nil {
+		return err
+	}
+	if err := hls.writeInt32(4, flags); err != nil {
+		return err
+	}
+	if err := hls.writeInt32(8, uint32(cnt)); err != nil {
+		return err
+	}
+	switch hls.version {
+	case 1:
+		if err := hls.writeInt32(12, uint32(time.Now().Unix())); err != nil {
+			return err
+		}
+	default:
+		if err := hls.writeInt64(16, uint64(time.Now().Unix())); err != nil {
+			return err
+		}
 
-	// we're all done, now write ID in the header (we do that as final step on purpose)
-	hls.f.WriteAt([]byte{'H', 'L', 'S', 1}, 0)
+		// checksum covers the final header, including magic
+		hdr := make([]byte, hlsfile.HeaderLen(hls.version, int64(cnt)))
+		if _, err := hls.f.ReadAt(hdr, 0); err != nil {
+			return err
+		}
+		copy(hdr, []byte{'H', 'L', 'S', hls.version})
+		if err := hls.writeInt32(12, hlsfile.HeaderChecksum(hdr)); err != nil {
+			return err
+		}
+	}
 
-	return nil
+	// we're all done, now write ID in the header (we do that as final step on purpose)
+	_, err = hls.f.WriteAt([]byte{'H', 'L', 'S', hls.version}, 0)
+	return err
 }
 
-func (hls *hlsBuilder) getFile(fn string) (int64, int64, error) {
+func (hls *hlsBuilder) getFile(fn string) (*fileInfo, error) {
 	nfo, ok := hls.files[fn]
 	if ok {
-		return nfo.pos, nfo.ln, nil
+		return nfo, nil
 	}
 	//log.Printf("hls: appending %s", fn)
 	full := filepath.Join(hls.dir, fn)
 	read, err := os.Open(full)
 	if err != nil {
-		return 0, 0, err
+		return nil, err
 	}
 	defer read.Close()
 
 	pos, err := hls.f.Seek(0, io.SeekCurrent)
 	if err != nil {
-		return 0, 0, err
+		return nil, err
 	}
 
 	// copy data
-	ln, err := io.Copy(hls.f, read)
+	h := hlsfile.NewHash()
+	ln, err := io.Copy(io.MultiWriter(hls.f, h), read)
 	if err != nil {
-		return 0, 0, err
+		return nil, err
+	}
+	nfo = &fileInfo{pos: pos, ln: ln, sum: h.Sum32()}
+	hls.files[fn] = nfo
+	return nfo, nil
+}
+
+// appendData appends buf to the output file
+func (hls *hlsBuilder) appendData(buf []byte) (*fileInfo, error) {
+	pos, err := hls.f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	ln, err := hls.f.Write(buf)
+	if err != nil {
+		return nil, err
 	}
-	hls.files[fn] = &fileInfo{pos: pos, ln: ln}
-	return pos, ln, nil
+	return &fileInfo{pos: pos, ln: int64(ln), sum: hlsfile.Checksum(buf)}, nil
 }
 
-func (hls *hlsBuilder) writeInt32(pos int, v uint32) error {
+// writeEntry writes entry n in the header, n=-1 being master
+func (hls *hlsBuilder) writeEntry(n int, nfo *fileInfo, flags uint32) error {
+	p := hlsfile.EntryPos(hls.version, n)
+	if err := hls.writeInt64(p, uint64(nfo.pos)); err != nil {
+		return err
+	}
+
+	switch hls.version {
+	case 1:
+		if nfo.ln > math.MaxUint32 {
+			return fmt.Errorf("entry %d is too large (%d bytes) for hls_version 1", n, nfo.ln)
+		}
+		if err := hls.writeInt32(p+8, flags); err != nil {
+			return err
+		}
+		return hls.writeInt32(p+12, uint32(nfo.ln))
+	default:
+		if err := hls.writeInt64(p+8, uint64(nfo.ln)); err != nil {
+			return err
+		}
+		if err := hls.writeInt32(p+16, flags); err != nil {
+			return err
+		}
+		return hls.writeInt32(p+20, nfo.sum)
+	}
+}
+
+func (hls *hlsBuilder) writeInt32(pos int64, v uint32) error {
 	var buf [4]byte
 	binary.BigEndian.PutUint32(buf[:], v)
-	_, err := hls.f.WriteAt(buf[:], int64(pos))
+	_, err := hls.f.WriteAt(buf[:], pos)
 	return err
 }
 
-func (hls *hlsBuilder) writeInt64(pos int, v uint64) error {
+func (hls *hlsBuilder) writeInt64(pos int64, v uint64) error {
 	var buf [8]byte
 	binary.BigEndian.PutUint64(buf[:], v)
-	_, err := hls.f.WriteAt(buf[:], int64(pos))
+	_, err := hls.f.WriteAt(buf[:], pos)
 	return err
 }
 
@@ -338,42 +536,25 @@ func (hls *hlsBuilder) Close() error {
 	} else {
 		log.Printf("Keeping temporary directory for debug, please delete once done: %s", hls.dir)
 	}
-	return hls.f.Close()
-}
-
-func hlsFlags(f *m3u8file) uint32 {
-	switch path.Ext(f.filename) {
-	case ".m3u8":
-		return FilePlaylist
-	case ".ts":
-		return FileMpegTS
-	case ".mp4":
-		return FileMP4
-	case ".vtt":
-		return FileVTT
-	case ".m4s":
-		return FileM4S
-	default:
-		panic(fmt.Sprintf("invalid filename %s", f.filename))
+	if hls.f == nil {
+		return nil
 	}
-	return 0
+	return hls.f.Close()
 }
 
 func hlsFlagsName(fn string) uint32 {
 	switch path.Ext(fn) {
 	case ".m3u8":
-		return FilePlaylist
+		return hlsfile.FilePlaylist
 	case ".ts":
-		return FileMpegTS
+		return hlsfile.FileMpegTS
 	case ".mp4":
-		return FileMP4
+		return hlsfile.FileMP4
 	case ".vtt":
-		return FileVTT
+		return hlsfile.FileVTT
 	case ".m4s":
-		return FileM4S
+		return hlsfile.FileM4S
 	default:
 		panic(fmt.Sprintf("invalid filename %s", fn))
-
 	}
-	return 0
 }
@@ -0,0 +1,391 @@
+// Package hlsfile reads the packed HLS container written by hlsmaker.
+//
+// A packed file holds a master playlist, a number of media playlists and all
+// the media files they reference. Playlists reference other entries by their
+// index in the entry table, as "<n>.m3u8" for playlists or "<n><ext>" for
+// media files, so a server only needs to map these names to offsets.
+//
+// Version 1 header is 16 bytes:
+// HLS<v>
+// <4 bytes flags>
+// <4 bytes number of entries>
+// <4 bytes timestamp>
+// for master and each entry: <8 bytes offset> <4 bytes flags> <4 bytes length>
+//
+// Version 2 header is 32 bytes:
+// HLS<v>
+// <4 bytes flags>
+// <4 bytes number of entries>
+// <4 bytes CRC32C of header and entry table, computed with this field set to zero>
+// <8 bytes timestamp>
+// <8 bytes reserved>
+// for master and each entry: <8 bytes offset> <8 bytes length> <4 bytes flags> <4 bytes CRC32C of data>
+//
+// All values are big endian.
+package hlsfile
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// entry types, stored in the entry flags
+const (
+	FilePlaylist = iota
+	FileMpegTS
+	FileMP4
+	FileVTT
+	FileM4S
+	FileMetadata // JSON metadata, not referenced by playlists
+	FileMPD      // MPEG-DASH manifest, not referenced by playlists
+)
+
+// header flags
+const (
+	FlagMetadata = 1 << iota // file contains a FileMetadata entry
+	FlagDASH                 // file contains a FileMPD entry
+)
+
+var (
+	ErrInvalidMagic       = errors.New("hlsfile: invalid magic")
+	ErrUnsupportedVersion = errors.New("hlsfile: unsupported version")
+	ErrTruncated          = errors.New("hlsfile: file is truncated")
+	ErrChecksum           = errors.New("hlsfile: checksum mismatch")
+
+	castagnoli = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// File is an opened packed HLS file
+type File struct {
+	Version byte
+	Flags   uint32
+	Created time.Time
+	Master  *Entry   // master playlist
+	Entries []*Entry // playlists and media files, by index
+
+	r    io.ReaderAt
+	size int64
+	c    io.Closer
+}
+
+// Entry is a single file stored in the container
+type Entry struct {
+	Index    int // index in the entry table, -1 for master
+	Offset   int64
+	Flags    uint32
+	Length   int64
+	Checksum uint32 // CRC32C of data, version 2 and up
+}
+
+// Open opens the given packed file, the returned File must be closed after use
+func Open(fn string) (*File, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	res, err := New(f, st.Size())
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	res.c = f
+	return res, nil
+}
+
+// New parses the header of a packed file of the given size accessed through r
+func New(r io.ReaderAt, size int64) (*File, error) {
+	var hdr [16]byte
+	if _, err := r.ReadAt(hdr[:], 0); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, ErrTruncated
+		}
+		return nil, err
+	}
+	if string(hdr[:3]) != "HLS" {
+		return nil, ErrInvalidMagic
+	}
+
+	f := &File{
+		Version: hdr[3],
+		Flags:   binary.BigEndian.Uint32(hdr[4:8]),
+		r:       r,
+		size:    size,
+	}
+	if f.Version != 1 && f.Version != 2 {
+		return nil, fmt.Errorf("%w %d", ErrUnsupportedVersion, f.Version)
+	}
+
+	cnt := int64(binary.BigEndian.Uint32(hdr[8:12]))
+	hdrLen := HeaderLen(f.Version, cnt)
+	if hdrLen > size {
+		return nil, fmt.Errorf("%w: header declares %d entries", ErrTruncated, cnt)
+	}
+
+	// read the whole header including master + entries table
+	buf := make([]byte, hdrLen)
+	if _, err := r.ReadAt(buf, 0); err != nil {
+		return nil, err
+	}
+
+	switch f.Version {
+	case 1:
+		f.Created = time.Unix(int64(binary.BigEndian.Uint32(buf[12:16])), 0)
+	default:
+		if HeaderChecksum(buf) != binary.BigEndian.Uint32(buf[12:16]) {
+			return nil, fmt.Errorf("%w in header", ErrChecksum)
+		}
+		f.Created = time.Unix(int64(binary.BigEndian.Uint64(buf[16:24])), 0)
+	}
+
+	f.Master = f.parseEntry(-1, buf)
+	f.Entries = make([]*Entry, cnt)
+	for n := range f.Entries {
+		f.Entries[n] = f.parseEntry(n, buf)
+	}
+
+	// entries must be within the file, written so the sum cannot overflow
+	for _, e := range append([]*Entry{f.Master}, f.Entries...) {
+		if e.Offset < 0 || e.Length < 0 || e.Length > size-e.Offset {
+			return nil, fmt.Errorf("%w: entry %s extends past end of file (%d bytes)", ErrTruncated, e, size)
+		}
+	}
+
+	return f, nil
+}
+
+func (f *File) parseEntry(n int, hdr []byte) *Entry {
+	buf := hdr[EntryPos(f.Version, n):]
+	e := &Entry{
+		Index:  n,
+		Offset: int64(binary.BigEndian.Uint64(buf[:8])),
+	}
+	switch f.Version {
+	case 1:
+		e.Flags = binary.BigEndian.Uint32(buf[8:12])
+		e.Length = int64(binary.BigEndian.Uint32(buf[12:16]))
+	default:
+		e.Length = int64(binary.BigEndian.Uint64(buf[8:16]))
+		e.Flags = binary.BigEndian.Uint32(buf[16:20])
+		e.Checksum = binary.BigEndian.Uint32(buf[20:24])
+	}
+	return e
+}
+
+// HeaderLen returns the size of the header including the entry table for a
+// file of the given version containing cnt entries (not including master)
+func HeaderLen(version byte, cnt int64) int64 {
+	return EntryPos(version, int(cnt))
+}
+
+// EntryPos returns the position of entry n in the header, with -1 meaning
+// the master playlist
+func EntryPos(version byte, n int) int64 {
+	switch version {
+	case 1:
+		return 32 + int64(n)*16
+	default:
+		return 56 + int64(n)*24
+	}
+}
+
+// HeaderChecksum computes the checksum of a version 2 header, hdr must
+// contain the whole header including the entry table
+func HeaderChecksum(hdr []byte) uint32 {
+	h := crc32.New(castagnoli)
+	h.Write(hdr[:12])
+	h.Write([]byte{0, 0, 0, 0})
+	h.Write(hdr[16:])
+	return h.Sum32()
+}
+
+// NewHash returns a hash computing entry checksums
+func NewHash() hash.Hash32 {
+	return crc32.New(castagnoli)
+}
+
+// Checksum returns the entry checksum of the given data
+func Checksum(buf []byte) uint32 {
+	return crc32.Checksum(buf, castagnoli)
+}
+
+// Size returns the total size of the packed file
+func (f *File) Size() int64 {
+	return f.size
+}
+
+// Close closes the underlying file if it was opened with Open
+func (f *File) Close() error {
+	if f.c == nil {
+		return nil
+	}
+	return f.c.Close()
+}
+
+// Reader returns a reader for the given entry's data
+func (f *File) Reader(e *Entry) *io.SectionReader {
+	return io.NewSectionReader(f.r, e.Offset, e.Length)
+}
+
+// ReadEntry returns the whole data of an entry, typically used for playlists
+func (f *File) ReadEntry(e *Entry) ([]byte, error) {
+	buf := make([]byte, e.Length)
+	_, err := f.r.ReadAt(buf, e.Offset)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, ErrTruncated
+		}
+		return nil, err
+	}
+	return buf, nil
+}
+
+// CheckEntry reads the entry's data and compares it against its checksum. On
+// version 1 files which do not have checksums, it only checks the data can be
+// read.
+func (f *File) CheckEntry(e *Entry) error {
+	h := NewHash()
+	n, err := io.Copy(h, f.Reader(e))
+	if err != nil {
+		return err
+	}
+	if n != e.Length {
+		return ErrTruncated
+	}
+	if f.Version >= 2 && h.Sum32() != e.Checksum {
+		return ErrChecksum
+	}
+	return nil
+}
+
+// Lookup returns the entry matching the given name, which is either
+// "master.m3u8", "manifest.mpd" or a name as referenced from the playlists
+// such as "3.m3u8" or "12.m4s"
+func (f *File) Lookup(name string) (*Entry, error) {
+	switch name {
+	case "master.m3u8":
+		return f.Master, nil
+	case "manifest.mpd":
+		if e := f.Find(FileMPD); e != nil {
+			return e, nil
+		}
+		return nil, fs.ErrNotExist
+	}
+	ext := path.Ext(name)
+	n, err := strconv.ParseUint(strings.TrimSuffix(name, ext), 10, 31)
+	if err != nil || int(n) >= len(f.Entries) {
+		return nil, fs.ErrNotExist
+	}
+	e := f.Entries[n]
+	if e.Ext() != ext {
+		return nil, fs.ErrNotExist
+	}
+	return e, nil
+}
+
+// Find returns the first entry of the given type, or nil if none
+func (f *File) Find(typ uint32) *Entry {
+	for _, e := range f.Entries {
+		if e.Type() == typ {
+			return e
+		}
+	}
+	return nil
+}
+
+// Name returns the name this entry is referenced as from playlists
+func (e *Entry) Name() string {
+	if e.Index == -1 {
+		return "master.m3u8"
+	}
+	return strconv.Itoa(e.Index) + e.Ext()
+}
+
+// Type returns the entry type, one of the FileXXX constants
+func (e *Entry) Type() uint32 {
+	return e.Flags
+}
+
+// TypeName returns the name of the entry type constant, such as "FileM4S"
+func (e *Entry) TypeName() string {
+	switch e.Type() {
+	case FilePlaylist:
+		return "FilePlaylist"
+	case FileMpegTS:
+		return "FileMpegTS"
+	case FileMP4:
+		return "FileMP4"
+	case FileVTT:
+		return "FileVTT"
+	case FileM4S:
+		return "FileM4S"
+	case FileMetadata:
+		return "FileMetadata"
+	case FileMPD:
+		return "FileMPD"
+	default:
+		return fmt.Sprintf("File(%d)", e.Type())
+	}
+}
+
+// Ext returns the file extension for this entry's type
+func (e *Entry) Ext() string {
+	switch e.Type() {
+	case FilePlaylist:
+		return ".m3u8"
+	case FileMpegTS:
+		return ".ts"
+	case FileMP4:
+		return ".mp4"
+	case FileVTT:
+		return ".vtt"
+	case FileM4S:
+		return ".m4s"
+	case FileMetadata:
+		return ".json"
+	case FileMPD:
+		return ".mpd"
+	default:
+		return ".bin"
+	}
+}
+
+// ContentType returns the mime type for this entry's type
+func (e *Entry) ContentType() string {
+	switch e.Type() {
+	case FilePlaylist:
+		return "application/vnd.apple.mpegurl"
+	case FileMpegTS:
+		return "video/mp2t"
+	case FileMP4:
+		return "video/mp4"
+	case FileVTT:
+		return "text/vtt"
+	case FileM4S:
+		return "video/iso.segment"
+	case FileMetadata:
+		return "application/json"
+	case FileMPD:
+		return "application/dash+xml"
+	default:
+		return "application/octet-stream"
+	}
+}
+
+func (e *Entry) String() string {
+	return fmt.Sprintf("%s@%d+%d", e.Name(), e.Offset, e.Length)
+}
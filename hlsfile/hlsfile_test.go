@@ -0,0 +1,240 @@
+package hlsfile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/fs"
+	"math"
+	"strings"
+	"testing"
+)
+
+type testEntry struct {
+	typ  uint32
+	data string
+}
+
+// makeTestFile builds a packed file in memory
+func makeTestFile(version byte, master string, entries []testEntry) []byte {
+	hdrLen := HeaderLen(version, int64(len(entries)))
+	buf := make([]byte, hdrLen)
+	copy(buf, "HLS")
+	buf[3] = version
+	binary.BigEndian.PutUint32(buf[8:], uint32(len(entries)))
+	if version == 1 {
+		binary.BigEndian.PutUint32(buf[12:], 1700000000)
+	} else {
+		binary.BigEndian.PutUint64(buf[16:], 1700000000)
+	}
+
+	put := func(n int, typ uint32, data string) {
+		pos := EntryPos(version, n)
+		binary.BigEndian.PutUint64(buf[pos:], uint64(len(buf)))
+		if version == 1 {
+			binary.BigEndian.PutUint32(buf[pos+8:], typ)
+			binary.BigEndian.PutUint32(buf[pos+12:], uint32(len(data)))
+		} else {
+			binary.BigEndian.PutUint64(buf[pos+8:], uint64(len(data)))
+			binary.BigEndian.PutUint32(buf[pos+16:], typ)
+			binary.BigEndian.PutUint32(buf[pos+20:], Checksum([]byte(data)))
+		}
+		buf = append(buf, data...)
+	}
+	for n, e := range entries {
+		put(n, e.typ, e.data)
+	}
+	put(-1, 0, master)
+	if version >= 2 {
+		binary.BigEndian.PutUint32(buf[12:], HeaderChecksum(buf[:hdrLen]))
+	}
+	return buf
+}
+
+func TestParse(t *testing.T) {
+	for _, version := range []byte{1, 2} {
+		testParse(t, version)
+	}
+}
+
+func testParse(t *testing.T, version byte) {
+	data := makeTestFile(version, "#EXTM3U\n0.m3u8\n", []testEntry{
+		{FilePlaylist, "#EXTM3U\n#EXT-X-MAP:URI=\"1.mp4\"\n2.m4s\n"},
+		{FileMP4, "init"},
+		{FileM4S, "segment"},
+	})
+
+	f, err := New(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("v%d: failed to parse: %s", version, err)
+	}
+	if f.Version != version || len(f.Entries) != 3 || f.Created.Unix() != 1700000000 {
+		t.Errorf("unexpected header: version=%d entries=%d created=%s", f.Version, len(f.Entries), f.Created)
+	}
+
+	master, err := f.ReadEntry(f.Master)
+	if err != nil || string(master) != "#EXTM3U\n0.m3u8\n" {
+		t.Errorf("unexpected master %q (err=%v)", master, err)
+	}
+
+	e, err := f.Lookup("2.m4s")
+	if err != nil {
+		t.Fatalf("lookup failed: %s", err)
+	}
+	if e.Type() != FileM4S || e.ContentType() != "video/iso.segment" {
+		t.Errorf("unexpected entry %s type %d", e, e.Type())
+	}
+	seg, _ := io.ReadAll(f.Reader(e))
+	if string(seg) != "segment" {
+		t.Errorf("unexpected segment data %q", seg)
+	}
+	if err := f.CheckEntry(e); err != nil {
+		t.Errorf("unexpected check error: %s", err)
+	}
+
+	for _, name := range []string{"2.mp4", "3.m4s", "x.m3u8", "-1.m3u8"} {
+		if _, err := f.Lookup(name); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("lookup %s: expected not exist, got %v", name, err)
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	data := makeTestFile(1, "#EXTM3U\n", nil)
+
+	bad := append([]byte{}, data...)
+	bad[0] = 'X'
+	if _, err := New(bytes.NewReader(bad), int64(len(bad))); !errors.Is(err, ErrInvalidMagic) {
+		t.Errorf("expected invalid magic, got %v", err)
+	}
+
+	bad = append([]byte{}, data...)
+	bad[3] = 9
+	if _, err := New(bytes.NewReader(bad), int64(len(bad))); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("expected unsupported version, got %v", err)
+	}
+
+	bad = append([]byte{}, data...)
+	binary.BigEndian.PutUint32(bad[8:], 1000)
+	if _, err := New(bytes.NewReader(bad), int64(len(bad))); !errors.Is(err, ErrTruncated) {
+		t.Errorf("expected truncated, got %v", err)
+	}
+
+	// entries out of the file, including lengths that overflow the offset
+	for _, v := range [][2]uint64{{32, 1 << 40}, {1 << 63, 1}, {32, 1<<63 - 1}, {1 << 40, 0}} {
+		bad = makeTestFile(2, "#EXTM3U\n", nil)
+		binary.BigEndian.PutUint64(bad[EntryPos(2, -1):], v[0])
+		binary.BigEndian.PutUint64(bad[EntryPos(2, -1)+8:], v[1])
+		binary.BigEndian.PutUint32(bad[12:], HeaderChecksum(bad[:HeaderLen(2, 0)]))
+		if _, err := New(bytes.NewReader(bad), int64(len(bad))); !errors.Is(err, ErrTruncated) {
+			t.Errorf("%d+%d: expected truncated, got %v", v[0], v[1], err)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	entries := []testEntry{
+		{FilePlaylist, "#EXTM3U\n#EXT-X-MAP:URI=\"1.mp4\"\n#EXTINF:4,\n2.m4s\n#EXTINF:4,\n3.m4s\n"},
+		{FileMP4, "init"},
+		{FileM4S, "segment"},
+		{FileM4S, "segment"},
+		{FileMPD, "<MPD/>"},
+	}
+	data := makeTestFile(1, "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1\n0.m3u8\n", entries)
+	f, err := New(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("failed to parse: %s", err)
+	}
+	if errs := f.Verify(); len(errs) != 0 {
+		t.Errorf("unexpected errors on valid file: %v", errs)
+	}
+	if e, err := f.Lookup("manifest.mpd"); err != nil || e.Index != 4 || e.ContentType() != "application/dash+xml" {
+		t.Errorf("unexpected manifest lookup %v (err=%v)", e, err)
+	}
+
+	refs, _ := f.Refs(f.Entries[0])
+	if len(refs) != 3 || refs[1].URI != "2.m4s" || refs[1].Map != "1.mp4" {
+		t.Errorf("unexpected refs %+v", refs)
+	}
+
+	// reference to a missing entry, and 3.m4s unreferenced
+	entries[0].data = "#EXTM3U\n#EXT-X-MAP:URI=\"1.mp4\"\n#EXTINF:4,\n2.m4s\n#EXTINF:4,\n4.m4s\n"
+	data = makeTestFile(1, "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1\n0.m3u8\n", entries)
+	f, _ = New(bytes.NewReader(data), int64(len(data)))
+	if errs := f.Verify(); len(errs) != 2 {
+		t.Errorf("expected 2 errors, got %v", errs)
+	}
+
+	// overlapping entries
+	data = makeTestFile(1, "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1\n0.m3u8\n", entries)
+	binary.BigEndian.PutUint64(data[EntryPos(1, 3):], uint64(f.Entries[2].Offset))
+	f, _ = New(bytes.NewReader(data), int64(len(data)))
+	if errs := f.Verify(); len(errs) != 1 {
+		t.Errorf("expected 1 error, got %v", errs)
+	}
+
+	// lengths overflowing the offset are still out of the file
+	data = makeTestFile(1, "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1\n0.m3u8\n", entries)
+	f, _ = New(bytes.NewReader(data), int64(len(data)))
+	f.Entries[4].Length = math.MaxInt64 - f.Entries[4].Offset + 1
+	if errs := f.Verify(); len(errs) == 0 || !strings.Contains(errs[0].Error(), "past end of file") {
+		t.Errorf("expected out of file error for overflowing length, got %v", errs)
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	entries := []testEntry{
+		{FilePlaylist, "#EXTM3U\n#EXT-X-MAP:URI=\"1.mp4\"\n#EXTINF:4,\n2.m4s\n"},
+		{FileMP4, "init"},
+		{FileM4S, "segment"},
+	}
+	data := makeTestFile(2, "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1\n0.m3u8\n", entries)
+
+	// flip a bit in the header
+	bad := append([]byte{}, data...)
+	bad[EntryPos(2, 1)+10] ^= 1
+	if _, err := New(bytes.NewReader(bad), int64(len(bad))); !errors.Is(err, ErrChecksum) {
+		t.Errorf("expected checksum error, got %v", err)
+	}
+
+	// flip a bit in the data
+	bad = append([]byte{}, data...)
+	bad[len(bad)-len("#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1\n0.m3u8\n")-1] ^= 1
+	f, err := New(bytes.NewReader(bad), int64(len(bad)))
+	if err != nil {
+		t.Fatalf("failed to parse: %s", err)
+	}
+	if err := f.CheckEntry(f.Entries[2]); !errors.Is(err, ErrChecksum) {
+		t.Errorf("expected checksum error, got %v", err)
+	}
+	if errs := f.Verify(); len(errs) != 1 {
+		t.Errorf("expected 1 error, got %v", errs)
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	entries := []testEntry{
+		{FilePlaylist, "#EXTM3U\n#EXTINF:4,\n1.m4s\n"},
+		{FileM4S, "segment"},
+		{FileMetadata, `{"hlsmaker_version":"v1.0.0","source":{"duration":4.5}}`},
+	}
+	data := makeTestFile(1, "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1\n0.m3u8\n", entries)
+	f, _ := New(bytes.NewReader(data), int64(len(data)))
+	if _, err := f.Metadata(); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected no metadata without flag, got %v", err)
+	}
+
+	binary.BigEndian.PutUint32(data[4:], FlagMetadata)
+	f, _ = New(bytes.NewReader(data), int64(len(data)))
+	meta, err := f.Metadata()
+	if err != nil {
+		t.Fatalf("failed to read metadata: %s", err)
+	}
+	if meta.Version != "v1.0.0" || meta.Source.Duration != 4.5 {
+		t.Errorf("unexpected metadata %+v", meta)
+	}
+	if errs := f.Verify(); len(errs) != 0 {
+		t.Errorf("unexpected errors: %v", errs)
+	}
+}
@@ -0,0 +1,144 @@
+package hlsfile
+
+import (
+	"encoding/json"
+	"io/fs"
+	"time"
+)
+
+// Metadata is stored as a JSON entry of type FileMetadata when the header
+// has FlagMetadata set
+type Metadata struct {
+	Version  string         `json:"hlsmaker_version"` // version of hlsmaker that built the file
+	Created  time.Time      `json:"created"`
+	Source   *SourceInfo    `json:"source,omitempty"`
+	Variants []*VariantInfo `json:"variants,omitempty"`
+	Audio    []*AudioInfo   `json:"audio,omitempty"`
+	Encoder  *EncoderInfo   `json:"encoder,omitempty"`
+
+	Complexity *ComplexityInfo `json:"complexity,omitempty"` // per-title mode only
+}
+
+// SourceInfo describes the input file, as reported by ffprobe
+type SourceInfo struct {
+	Format   string            `json:"format"`
+	Duration float64           `json:"duration"`
+	Size     int64             `json:"size"`
+	BitRate  int               `json:"bit_rate"`
+	Tags     map[string]string `json:"tags,omitempty"`
+	Chapters []*ChapterInfo    `json:"chapters,omitempty"`
+	Streams  []*StreamInfo     `json:"streams,omitempty"`
+}
+
+type ChapterInfo struct {
+	Start float64 `json:"start"`
+	End   float64 `json:"end"`
+	Title string  `json:"title,omitempty"`
+}
+
+// StreamInfo describes a source stream that was included in the output
+type StreamInfo struct {
+	Index      int     `json:"index"`
+	Type       string  `json:"type"` // video, audio or subtitle
+	Codec      string  `json:"codec"`
+	Profile    string  `json:"profile,omitempty"`
+	Width      int     `json:"width,omitempty"`
+	Height     int     `json:"height,omitempty"`
+	FrameRate  float64 `json:"frame_rate,omitempty"`
+	SampleRate int     `json:"sample_rate,omitempty"`
+	Language   string  `json:"language,omitempty"`
+	Title      string  `json:"title,omitempty"`
+}
+
+// LoudnessInfo is the EBU R128 loudness of a source audio track downmixed to
+// the channels of a rendition, measured by the first loudnorm pass before
+// normalizing it to Target
+type LoudnessInfo struct {
+	Integrated float64 `json:"integrated"` // LUFS
+	TruePeak   float64 `json:"true_peak"`  // dBTP
+	Range      float64 `json:"range"`      // LU
+	Threshold  float64 `json:"threshold"`  // LUFS
+	Offset     float64 `json:"offset"`     // LU
+	Target     float64 `json:"target"`     // LUFS
+	Gain       float64 `json:"gain"`       // dB, applied to the track
+	Linear     bool    `json:"linear"`     // false if loudnorm could not stay linear, and a peak limited gain was applied instead
+}
+
+// VariantInfo describes one rung of the video ladder
+type VariantInfo struct {
+	Codec       string `json:"codec"`
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	Bitrate     uint64 `json:"bitrate"`      // nominal bitrate
+	RateControl string `json:"rate_control"` // cbr, vbr or crf
+	CRF         int    `json:"crf,omitempty"`
+	MaxRate     uint64 `json:"max_rate,omitempty"`
+
+	Quality *QualityInfo `json:"quality,omitempty"`
+}
+
+// AudioInfo describes one audio rendition, encoded from a source track
+type AudioInfo struct {
+	Index    int    `json:"index"` // source stream index
+	Codec    string `json:"codec"` // aac, he-aac, opus, ac3 or eac3
+	Bitrate  uint64 `json:"bitrate"`
+	Channels int    `json:"channels"`
+	Group    string `json:"group"` // EXT-X-MEDIA GROUP-ID
+	Language string `json:"language,omitempty"`
+
+	Passthrough bool          `json:"passthrough,omitempty"` // copied from the source without transcoding
+	Loudness    *LoudnessInfo `json:"loudness,omitempty"`    // audio normalized with -loudnorm only
+}
+
+// QualityInfo is the objective quality of a variant, measured against the
+// source scaled to the same size
+type QualityInfo struct {
+	SSIM float64 `json:"ssim"`
+	PSNR float64 `json:"psnr"`           // dB
+	VMAF float64 `json:"vmaf,omitempty"` // only when ffmpeg has libvmaf
+
+	BelowThreshold []string `json:"below_threshold,omitempty"` // metrics under the configured minimum
+}
+
+// ComplexityInfo is the complexity of the source measured in per-title mode,
+// by encoding sampled segments at constant quality
+type ComplexityInfo struct {
+	Width        int                 `json:"width"` // size of the probe encodes
+	Height       int                 `json:"height"`
+	Samples      []*ComplexitySample `json:"samples"`
+	BitsPerPixel float64             `json:"bits_per_pixel"`    // average of samples
+	Factor       float64             `json:"factor"`            // applied to ladder bitrates
+	Dropped      []string            `json:"dropped,omitempty"` // variants merged into the next smaller size
+}
+
+type ComplexitySample struct {
+	Start        float64 `json:"start"`
+	BitsPerPixel float64 `json:"bits_per_pixel"`
+}
+
+// EncoderInfo holds the settings used for encoding
+type EncoderInfo struct {
+	Software  bool    `json:"software"`
+	Fast      bool    `json:"fast,omitempty"`
+	Filters   string  `json:"filters,omitempty"`
+	Ladder    string  `json:"ladder,omitempty"` // ladder profile file, empty for the built-in ladder
+	FrameRate float64 `json:"frame_rate"`
+}
+
+// Metadata returns the metadata stored in the file, or fs.ErrNotExist if the
+// file has none
+func (f *File) Metadata() (*Metadata, error) {
+	e := f.Find(FileMetadata)
+	if f.Flags&FlagMetadata == 0 || e == nil {
+		return nil, fs.ErrNotExist
+	}
+	buf, err := f.ReadEntry(e)
+	if err != nil {
+		return nil, err
+	}
+	var res *Metadata
+	if err := json.Unmarshal(buf, &res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
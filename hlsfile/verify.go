@@ -0,0 +1,149 @@
+package hlsfile
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Ref is a reference to another entry found in a playlist
+type Ref struct {
+	URI string // referenced name
+	Map string // for media segments, the init segment from EXT-X-MAP if any
+}
+
+// Refs returns all the references found in the given playlist entry, in the
+// order they appear
+func (f *File) Refs(e *Entry) ([]*Ref, error) {
+	buf, err := f.ReadEntry(e)
+	if err != nil {
+		return nil, err
+	}
+	return parseRefs(buf), nil
+}
+
+func parseRefs(buf []byte) []*Ref {
+	var res []*Ref
+	var init string
+
+	s := bufio.NewScanner(bytes.NewReader(buf))
+	for s.Scan() {
+		ln := strings.TrimSpace(s.Text())
+		if ln == "" {
+			continue
+		}
+		if ln[0] != '#' {
+			res = append(res, &Ref{URI: ln, Map: init})
+			continue
+		}
+		uri, ok := attrURI(ln)
+		if !ok {
+			continue
+		}
+		if strings.HasPrefix(ln, "#EXT-X-MAP:") {
+			init = uri
+		}
+		res = append(res, &Ref{URI: uri})
+	}
+	return res
+}
+
+// attrURI returns the value of the URI attribute of a tag line
+func attrURI(ln string) (string, bool) {
+	for _, pfx := range []string{":URI=\"", ",URI=\""} {
+		pos := strings.Index(ln, pfx)
+		if pos == -1 {
+			continue
+		}
+		v := ln[pos+len(pfx):]
+		end := strings.IndexByte(v, '"')
+		if end == -1 {
+			return "", false
+		}
+		return v[:end], true
+	}
+	return "", false
+}
+
+// Verify checks the consistency of the whole file: all entries must be within
+// the file, not overlap and match their checksum, and all references in playlists must point to an
+// existing entry of the right type. It returns all the problems found.
+func (f *File) Verify() []error {
+	var res []error
+	all := append([]*Entry{f.Master}, f.Entries...)
+	hdrLen := HeaderLen(f.Version, int64(len(f.Entries)))
+
+	// bounds
+	for _, e := range all {
+		if e.Offset < hdrLen {
+			res = append(res, fmt.Errorf("entry %s: offset %d is within the header (%d bytes)", e.Name(), e.Offset, hdrLen))
+		}
+		if e.Offset < 0 || e.Length < 0 || e.Length > f.size-e.Offset {
+			res = append(res, fmt.Errorf("entry %s: data at %d+%d extends past end of file (%d bytes)", e.Name(), e.Offset, e.Length, f.size))
+		}
+	}
+
+	// overlaps
+	sorted := make([]*Entry, 0, len(all))
+	for _, e := range all {
+		if e.Length > 0 {
+			sorted = append(sorted, e)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Offset < sorted[j].Offset })
+	for n := 1; n < len(sorted); n++ {
+		prev, e := sorted[n-1], sorted[n]
+		if prev.Length > e.Offset-prev.Offset {
+			res = append(res, fmt.Errorf("entry %s: data at %d+%d overlaps with entry %s at %d+%d", e.Name(), e.Offset, e.Length, prev.Name(), prev.Offset, prev.Length))
+		}
+	}
+	if len(res) > 0 {
+		// no point checking playlists if data can't be read
+		return res
+	}
+
+	// data
+	for _, e := range all {
+		if err := f.CheckEntry(e); err != nil {
+			res = append(res, fmt.Errorf("entry %s: %w", e.Name(), err))
+		}
+	}
+
+	// references
+	referenced := make(map[*Entry]bool)
+	for _, pl := range all {
+		if pl.Type() != FilePlaylist {
+			continue
+		}
+		refs, err := f.Refs(pl)
+		if err != nil {
+			res = append(res, fmt.Errorf("playlist %s: %w", pl.Name(), err))
+			continue
+		}
+		for _, ref := range refs {
+			e, err := f.Lookup(ref.URI)
+			if err != nil {
+				res = append(res, fmt.Errorf("playlist %s: reference to %s does not match any entry", pl.Name(), ref.URI))
+				continue
+			}
+			if e == f.Master {
+				res = append(res, fmt.Errorf("playlist %s: unexpected reference to master", pl.Name()))
+				continue
+			}
+			isPlaylist := e.Type() == FilePlaylist
+			if (pl == f.Master) != isPlaylist {
+				res = append(res, fmt.Errorf("playlist %s: reference to %s of unexpected type %s", pl.Name(), ref.URI, e.TypeName()))
+			}
+			referenced[e] = true
+		}
+	}
+	for _, e := range f.Entries {
+		if !referenced[e] && e.Type() != FileMetadata && e.Type() != FileMPD {
+			res = append(res, fmt.Errorf("entry %s: not referenced by any playlist", e.Name()))
+		}
+	}
+
+	return res
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/KarpelesLab/hlsmaker/hlsfile"
+)
+
+var (
+	jsonOutput = flag.Bool("json", false, "output json in inspect mode")
+)
+
+type inspectInfo struct {
+	Version   byte              `json:"version"`
+	Flags     uint32            `json:"flags"`
+	Entries   int               `json:"entries"`
+	Created   time.Time         `json:"created"`
+	Size      int64             `json:"size"`
+	Master    string            `json:"master"`
+	Playlists []*inspectPayload `json:"playlists"`
+	Table     []*inspectEntry   `json:"table"` // master and all entries
+	Metadata  *hlsfile.Metadata `json:"metadata,omitempty"`
+
+	MetadataError string `json:"metadata_error,omitempty"` // metadata entry could not be read
+}
+
+type inspectPayload struct {
+	Name    string `json:"name"`
+	Content string `json:"content"`
+}
+
+type inspectEntry struct {
+	Name     string `json:"name"`
+	Offset   int64  `json:"offset"`
+	Length   int64  `json:"length"`
+	Flags    uint32 `json:"flags"`
+	Type     string `json:"type"`
+	Checksum uint32 `json:"checksum,omitempty"`
+}
+
+// inspectCommand dumps the index and playlists of a packed hls file
+func inspectCommand(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: inspect [-json] file.hls")
+	}
+
+	f, err := hlsfile.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info := &inspectInfo{
+		Version: f.Version,
+		Flags:   f.Flags,
+		Entries: len(f.Entries),
+		Created: f.Created,
+		Size:    f.Size(),
+	}
+
+	buf, err := f.ReadEntry(f.Master)
+	if err != nil {
+		return fmt.Errorf("while reading master: %w", err)
+	}
+	info.Master = string(buf)
+
+	for _, e := range append([]*hlsfile.Entry{f.Master}, f.Entries...) {
+		info.Table = append(info.Table, &inspectEntry{
+			Name:     e.Name(),
+			Offset:   e.Offset,
+			Length:   e.Length,
+			Flags:    e.Flags,
+			Type:     e.TypeName(),
+			Checksum: e.Checksum,
+		})
+		if e.Index == -1 || (e.Type() != hlsfile.FilePlaylist && e.Type() != hlsfile.FileMPD) {
+			continue
+		}
+		buf, err := f.ReadEntry(e)
+		if err != nil {
+			return fmt.Errorf("while reading %s: %w", e.Name(), err)
+		}
+		info.Playlists = append(info.Playlists, &inspectPayload{Name: e.Name(), Content: string(buf)})
+	}
+
+	// this is a debugging tool, so invalid metadata is reported but does not
+	// prevent showing the rest of the file
+	if meta, err := f.Metadata(); err == nil {
+		info.Metadata = meta
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		info.MetadataError = err.Error()
+	}
+
+	if *jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(info)
+	}
+
+	fmt.Printf("Version: %d\n", info.Version)
+	fmt.Printf("Flags:   0x%08x\n", info.Flags)
+	fmt.Printf("Entries: %d\n", info.Entries)
+	fmt.Printf("Created: %s\n", info.Created.UTC().Format(time.RFC3339))
+	fmt.Printf("Size:    %d\n", info.Size)
+
+	fmt.Printf("\n== master.m3u8\n%s", info.Master)
+	for _, pl := range info.Playlists {
+		fmt.Printf("\n== %s\n%s", pl.Name, pl.Content)
+	}
+
+	if info.Metadata != nil {
+		buf, _ := json.MarshalIndent(info.Metadata, "", "  ")
+		fmt.Printf("\n== metadata\n%s\n", buf)
+	} else if info.MetadataError != "" {
+		fmt.Printf("\n== metadata\nerror: %s\n", info.MetadataError)
+	}
+
+	fmt.Printf("\n")
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "NAME\tOFFSET\tLENGTH\tTYPE\tCRC32C\n")
+	for _, m := range info.Table {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t%08x\n", m.Name, m.Offset, m.Length, m.Type, m.Checksum)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+)
+
+var (
+	ladderFile   = flag.String("ladder", "", "JSON ladder profile describing the video variants to generate (default: built-in ladder)")
+	h264Fallback = flag.Bool("h264_fallback", false, "also encode as H.264 the sizes the ladder only has in AV1 or HEVC, so H.264-only clients get the full ladder")
+)
+
+// Ladder is an encoding ladder profile, listing the video variants and audio
+// renditions to generate from the source
+type Ladder struct {
+	Rungs        []*Rung      `json:"rungs"`
+	H264Fallback bool         `json:"h264_fallback,omitempty"` // same as -h264_fallback
+	Audio        []*AudioRung `json:"audio,omitempty"`         // default: AAC 96k stereo
+}
+
+// Rung is a video variant of the ladder. Rungs that would upscale the source
+// are skipped, as well as rungs not matching their over/not_over conditions.
+// Zero values mean the built-in default for the codec.
+type Rung struct {
+	Height  int    `json:"height"`             // height (width for vertical videos), 0 for the source size
+	Codec   string `json:"codec"`              // h264, hevc or av1
+	Over    int    `json:"over,omitempty"`     // only if width or height is over this value
+	NotOver int    `json:"not_over,omitempty"` // only if width and height are at most this value
+
+	RateControl  string  `json:"rate_control,omitempty"`   // cbr, vbr or crf, see rateControl
+	Bitrate      uint64  `json:"bitrate,omitempty"`        // target bits/s
+	BitsPerPixel float64 `json:"bits_per_pixel,omitempty"` // used to compute the bitrate when not set
+	CRF          int     `json:"crf,omitempty"`            // quality in crf mode (cq for nvenc)
+	MaxRate      uint64  `json:"max_rate,omitempty"`       // bits/s cap in vbr and crf modes
+	Profile      string  `json:"profile,omitempty"`
+	Level        string  `json:"level,omitempty"`
+	GOP          int     `json:"gop,omitempty"` // keyframe interval in frames
+
+	codec Codec
+}
+
+// defaultLadder returns the built-in ladder: the source size and each
+// smaller step of vsize.smaller, as AV1 and HEVC over 1280 pixels and H.264
+// otherwise, with the default audio ladder
+func defaultLadder() *Ladder {
+	l := &Ladder{Audio: defaultAudioLadder()}
+	for _, h := range []int{0, 4320, 2160, 1440, 1080, 720, 480, 360, 240, 160} {
+		l.Rungs = append(l.Rungs,
+			&Rung{Height: h, Codec: "av1", Over: 1280, codec: AV1},
+			&Rung{Height: h, Codec: "hevc", Over: 1280, codec: HEVC},
+			&Rung{Height: h, Codec: "h264", NotOver: 1280, codec: H264},
+		)
+	}
+	return l
+}
+
+// loadLadder returns the ladder selected with -ladder
+func loadLadder() (*Ladder, error) {
+	if *ladderFile == "" {
+		return defaultLadder(), nil
+	}
+
+	buf, err := os.ReadFile(*ladderFile)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Ladder{}
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(l); err != nil {
+		return nil, fmt.Errorf("while reading ladder %s: %w", *ladderFile, err)
+	}
+	if len(l.Rungs) == 0 {
+		return nil, fmt.Errorf("ladder %s has no rungs", *ladderFile)
+	}
+	for n, r := range l.Rungs {
+		if err := r.validate(); err != nil {
+			return nil, fmt.Errorf("ladder %s: rung %d: %w", *ladderFile, n, err)
+		}
+	}
+	if len(l.Audio) == 0 {
+		l.Audio = defaultAudioLadder()
+	}
+	for n, r := range l.Audio {
+		if err := r.validate(); err != nil {
+			return nil, fmt.Errorf("ladder %s: audio rung %d: %w", *ladderFile, n, err)
+		}
+	}
+	return l, nil
+}
+
+func (r *Rung) validate() error {
+	var err error
+	if r.codec, err = parseCodec(r.Codec); err != nil {
+		return err
+	}
+	if r.Height < 0 || r.Over < 0 || r.NotOver < 0 || r.GOP < 0 || r.BitsPerPixel < 0 {
+		return errors.New("negative value")
+	}
+	if r.Height != 0 && r.Height < 160 {
+		return fmt.Errorf("height %d is too small", r.Height)
+	}
+	maxCRF := 51
+	if r.codec == AV1 {
+		maxCRF = 63
+	}
+	if r.CRF < 0 || r.CRF > maxCRF {
+		return fmt.Errorf("crf %d out of range for %s", r.CRF, r.codec)
+	}
+	switch r.rateControl() {
+	case "cbr":
+		if r.MaxRate > 0 || r.CRF > 0 {
+			return errors.New("max_rate and crf require vbr or crf rate control")
+		}
+	case "vbr":
+		if r.CRF > 0 {
+			return errors.New("crf requires crf rate control")
+		}
+		if r.Bitrate > 0 && r.MaxRate > 0 && r.MaxRate < r.Bitrate {
+			return errors.New("max_rate is lower than bitrate")
+		}
+	case "crf":
+		if r.Bitrate > 0 {
+			return errors.New("bitrate is not used in crf rate control, use max_rate")
+		}
+	default:
+		return fmt.Errorf("unsupported rate control %s", r.RateControl)
+	}
+	if r.Level != "" && r.codec == AV1 {
+		return errors.New("level is not supported for av1")
+	}
+	return nil
+}
+
+// rateControl returns the rate control mode of r:
+//   - cbr: constant bitrate (the default)
+//   - vbr: variable bitrate, capped at max_rate (the default if set)
+//   - crf: constant quality (the default if crf is set), capped at max_rate
+//
+// Without max_rate, the cap is 1.5 times the target bitrate.
+func (r *Rung) rateControl() string {
+	switch {
+	case r.RateControl != "":
+		return r.RateControl
+	case r.CRF > 0:
+		return "crf"
+	case r.MaxRate > 0:
+		return "vbr"
+	default:
+		return "cbr"
+	}
+}
+
+// variants returns the variants of the ladder for a source of size src, up
+// to -max_streams sizes
+func (l *Ladder) variants(src *vsize) []*hlsVariant {
+	var res []*hlsVariant
+	cur := src // smallest size so far, scaled step by step as vsize.smaller
+	var last *vsize
+
+	for _, r := range l.Rungs {
+		siz := src
+		if r.Height != 0 {
+			switch {
+			case r.Height >= src.short():
+				// do not upscale
+				continue
+			case r.Height == cur.short():
+				siz = cur
+			case r.Height < cur.short():
+				siz = cur.resize(r.Height)
+			default:
+				siz = src.resize(r.Height)
+			}
+			if siz == nil {
+				// too small
+				continue
+			}
+			if siz.short() < cur.short() {
+				cur = siz
+			}
+		}
+		if r.Over > 0 && !siz.isOver(r.Over) {
+			continue
+		}
+		if r.NotOver > 0 && siz.isOver(r.NotOver) {
+			continue
+		}
+		if last != nil && *siz != *last && len(res) >= *maxStreams {
+			break
+		}
+		last = siz
+		res = append(res, &hlsVariant{size: siz, codec: r.codec, rung: r})
+	}
+
+	if l.H264Fallback || *h264Fallback {
+		res = addH264Fallback(res)
+	}
+	return res
+}
+
+// h264Profiles are the profiles of a rung that are kept by its H.264 fallback
+var h264Profiles = []string{"baseline", "main", "high", "high10", "high422", "high444"}
+
+// addH264Fallback adds a H.264 variant after the last variant of each size
+// that has none, so clients only supporting H.264 can play all sizes. The
+// fallback keeps the rate control and bitrate settings of the last variant;
+// crf and level are not kept as their scale depends on the codec, and sizes
+// over 4096 pixels get a H.264 level 6 stream that only recent decoders play.
+func addH264Fallback(vs []*hlsVariant) []*hlsVariant {
+	var res []*hlsVariant
+	for n, v := range vs {
+		res = append(res, v)
+
+		sameSize := func(o *hlsVariant) bool { return *o.size == *v.size }
+		if slices.ContainsFunc(vs[n+1:], sameSize) {
+			continue
+		}
+		if slices.ContainsFunc(vs, func(o *hlsVariant) bool { return sameSize(o) && o.codec == H264 }) {
+			continue
+		}
+		s := v.settings()
+		r := &Rung{
+			Height:       s.Height,
+			Codec:        H264.String(),
+			RateControl:  s.rateControl(),
+			Bitrate:      s.Bitrate,
+			BitsPerPixel: s.BitsPerPixel,
+			MaxRate:      s.MaxRate,
+			GOP:          s.GOP,
+			codec:        H264,
+		}
+		if slices.Contains(h264Profiles, s.Profile) {
+			r.Profile = s.Profile
+		}
+		res = append(res, &hlsVariant{size: v.size, codec: H264, rung: r})
+	}
+	return res
+}
+
+// ladderCommand prints the ladder selected with -ladder, and the variants it
+// generates for a source of the given size if any
+func ladderCommand(args []string) error {
+	if len(args) > 1 {
+		return errors.New("usage: ladder [-ladder profile.json] [WxH]")
+	}
+
+	l, err := loadLadder()
+	if err != nil {
+		return err
+	}
+
+	if len(args) == 1 {
+		src := &vsize{}
+		if _, err := fmt.Sscanf(args[0], "%dx%d", &src.w, &src.h); err != nil || src.w <= 0 || src.h <= 0 {
+			return fmt.Errorf("invalid size %s", args[0])
+		}
+		for _, v := range l.variants(src) {
+			log.Printf("ladder: %s", v)
+		}
+		return nil
+	}
+
+	buf, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(append(buf, '\n'))
+	return err
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// legacyVariants is the ladder that was hard-coded before ladder profiles
+func legacyVariants(siz *vsize, maxStreams int) []*hlsVariant {
+	variants := func(v *vsize) []*hlsVariant {
+		if v.isOver(1280) {
+			return []*hlsVariant{{size: v, codec: AV1}, {size: v, codec: HEVC}}
+		}
+		return []*hlsVariant{{size: v, codec: H264}}
+	}
+
+	res := variants(siz)
+	for siz = siz.smaller(); siz != nil; siz = siz.smaller() {
+		if len(res) >= maxStreams {
+			break
+		}
+		res = append(res, variants(siz)...)
+	}
+	return res
+}
+
+// setLadder sets -ladder to a temporary profile for the duration of t, and
+// returns a function writing the profile
+func setLadder(t *testing.T) func(src string) {
+	fn := filepath.Join(t.TempDir(), "ladder.json")
+	old := *ladderFile
+	t.Cleanup(func() { *ladderFile = old })
+	*ladderFile = fn
+
+	return func(src string) {
+		t.Helper()
+		if err := os.WriteFile(fn, []byte(src), 0644); err != nil {
+			t.Fatalf("failed to write ladder: %s", err)
+		}
+	}
+}
+
+func TestDefaultLadder(t *testing.T) {
+	old := *maxStreams
+	t.Cleanup(func() { *maxStreams = old })
+
+	sizes := []vsize{
+		{3840, 2160}, {3840, 1610}, {1920, 1080}, {1440, 1080}, {1280, 720},
+		{1080, 1920}, {720, 1280}, {640, 480}, {7680, 4320}, {200, 200},
+	}
+	for _, ms := range []int{16, 3, 1} {
+		*maxStreams = ms
+		for _, siz := range sizes {
+			expect := legacyVariants(&siz, ms)
+			got := defaultLadder().variants(&siz)
+			if len(got) != len(expect) {
+				t.Errorf("%s max %d: expected %v, got %v", &siz, ms, expect, got)
+				continue
+			}
+			for n := range got {
+				if got[n].String() != expect[n].String() {
+					t.Errorf("%s max %d: variant %d: expected %s, got %s", &siz, ms, n, expect[n], got[n])
+				}
+			}
+		}
+	}
+}
+
+func TestLoadLadder(t *testing.T) {
+	writeLadder := setLadder(t)
+	writeLadder(`{"rungs": [
+		{"height": 0, "codec": "hevc", "crf": 22, "max_rate": 8000000},
+		{"height": 1080, "codec": "h264", "bitrate": 5000000, "profile": "high", "level": "4.1", "gop": 50},
+		{"height": 480, "codec": "h264", "bits_per_pixel": 0.12}
+	]}`)
+	l, err := loadLadder()
+	if err != nil {
+		t.Fatalf("failed to load ladder: %s", err)
+	}
+	vs := l.variants(&vsize{3840, 2160})
+	if len(vs) != 3 || vs[0].codec != HEVC || vs[1].String() != "h264@1920x1080" || vs[2].String() != "h264@852x480" {
+		t.Fatalf("unexpected variants %v", vs)
+	}
+	if br := vs[1].bitrate(30); br != 5000000 {
+		t.Errorf("unexpected bitrate %d", br)
+	}
+	if br := vs[2].bitrate(30); br != uint64(852*480*30*0.12) {
+		t.Errorf("unexpected bitrate %d", br)
+	}
+
+	// no upscaling
+	if vs := l.variants(&vsize{1280, 720}); len(vs) != 2 {
+		t.Errorf("unexpected variants %v", vs)
+	}
+
+	invalid := []string{
+		`{"rungs": []}`,
+		`{"rungs": [{"codec": "vp9"}]}`,
+		`{"rungs": [{"codec": "h264", "crf": 60}]}`,
+		`{"rungs": [{"codec": "h264", "crf": 20, "bitrate": 1000}]}`,
+		`{"rungs": [{"codec": "av1", "level": "5.1"}]}`,
+		`{"rungs": [{"codec": "h264", "resolution": "1080p"}]}`,
+	}
+	for _, src := range invalid {
+		writeLadder(src)
+		if _, err := loadLadder(); err == nil {
+			t.Errorf("expected error loading %s", src)
+		}
+	}
+}
+
+func TestH264Fallback(t *testing.T) {
+	l := defaultLadder()
+	l.H264Fallback = true
+	expect := []string{
+		"av1@7680x4320", "hevc@7680x4320", "h264@7680x4320",
+		"av1@3840x2160", "hevc@3840x2160", "h264@3840x2160",
+		"av1@2560x1440", "hevc@2560x1440", "h264@2560x1440",
+	}
+	vs := l.variants(&vsize{7680, 4320})
+	for n, e := range expect {
+		if vs[n].String() != e {
+			t.Errorf("variant %d: expected %s, got %s", n, e, vs[n])
+		}
+	}
+
+	// the fallback keeps the rate control of the rung it is added for
+	vs = addH264Fallback([]*hlsVariant{
+		{size: &vsize{3840, 2160}, codec: HEVC, rung: &Rung{Codec: "hevc", CRF: 22, MaxRate: 8000000, Profile: "main10", codec: HEVC}},
+		{size: &vsize{1920, 1080}, codec: AV1, rung: &Rung{Height: 1080, Codec: "av1", MaxRate: 4000000, BitsPerPixel: 0.05, Profile: "high", codec: AV1}},
+	})
+	if len(vs) != 4 {
+		t.Fatalf("unexpected variants %v", vs)
+	}
+	if r := vs[1].settings(); r.rateControl() != "crf" || r.CRF != 0 || r.MaxRate != 8000000 || r.Profile != "" || r.validate() != nil {
+		t.Errorf("unexpected crf fallback %+v", r)
+	}
+	if r := vs[3].settings(); r.rateControl() != "vbr" || r.MaxRate != 4000000 || r.BitsPerPixel != 0.05 || r.Profile != "high" || r.Height != 1080 {
+		t.Errorf("unexpected vbr fallback %+v", r)
+	}
+}
+
+func TestRateControl(t *testing.T) {
+	siz := &vsize{1280, 720}
+	tests := []struct {
+		rung     *Rung
+		software bool
+		expect   string
+	}{
+		{&Rung{codec: H264}, true, "-c:v libx264 -x264-params:v nal-hrd=cbr:force-cfr=1 -b:v 2764800 -maxrate:v 2764800 -minrate:v 2764800 -bufsize:v 5529600"},
+		{&Rung{codec: H264, RateControl: "vbr"}, true, "-c:v libx264 -x264-params:v nal-hrd=vbr:force-cfr=1 -b:v 2764800 -maxrate:v 4147200 -bufsize:v 8294400"},
+		{&Rung{codec: HEVC, CRF: 24, MaxRate: 3000000}, true, "-c:v libx265 -crf:v 24 -maxrate:v 3000000 -bufsize:v 6000000"},
+		{&Rung{codec: AV1, RateControl: "crf"}, true, "-c:v libaom-av1 -crf:v 32 -b:v 2903040"},
+		{&Rung{codec: HEVC, RateControl: "crf", CRF: 28}, false, "-c:v hevc_nvenc -pix_fmt:v yuv420p -preset:v p6 -rc:v vbr -cq:v 28 -b:v 0 -maxrate:v 3317760 -bufsize:v 6635520"},
+	}
+	for _, tt := range tests {
+		v := &hlsVariant{size: siz, codec: tt.rung.codec, rung: tt.rung}
+		args := strings.Join(v.codec.Args(tt.software, 30, v).Expand(), " ")
+		if !strings.HasPrefix(args, tt.expect) {
+			t.Errorf("unexpected arguments for %+v:\n%s\nexpected prefix:\n%s", tt.rung, args, tt.expect)
+		}
+	}
+}
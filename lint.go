@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/KarpelesLab/hlsmaker/hlsfile"
+)
+
+var (
+	lintBuild = flag.Bool("lint", false, "check generated playlists against RFC 8216 and fail on violations")
+)
+
+// lintTolerance is how much measured bitrates may exceed the declared
+// BANDWIDTH and AVERAGE-BANDWIDTH, as with Apple's mediastreamvalidator
+const lintTolerance = 0.1
+
+// lintCommand checks the playlists of a packed hls file, or of a dir or
+// byterange output directory
+func lintCommand(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: lint file.hls|directory")
+	}
+
+	var read func(name string) ([]byte, error)
+	var size func(name string) (int64, error)
+
+	if st, err := os.Stat(args[0]); err != nil {
+		return err
+	} else if st.IsDir() {
+		read = func(name string) ([]byte, error) {
+			return os.ReadFile(filepath.Join(args[0], name))
+		}
+		size = func(name string) (int64, error) {
+			st, err := os.Stat(filepath.Join(args[0], name))
+			if err != nil {
+				return 0, err
+			}
+			return st.Size(), nil
+		}
+	} else {
+		f, err := hlsfile.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		read = func(name string) ([]byte, error) {
+			if name == "master.m3u8" {
+				return f.ReadEntry(f.Master)
+			}
+			e, err := f.Lookup(name)
+			if err != nil {
+				return nil, err
+			}
+			return f.ReadEntry(e)
+		}
+		size = func(name string) (int64, error) {
+			e, err := f.Lookup(name)
+			if err != nil {
+				return 0, err
+			}
+			return e.Length, nil
+		}
+	}
+
+	errs := lintFiles(read, size)
+	if len(errs) > 0 {
+		for _, err := range errs {
+			log.Printf("lint: %s", err)
+		}
+		return fmt.Errorf("%d problems found in %s", len(errs), args[0])
+	}
+
+	log.Printf("lint: %s is valid", args[0])
+	return nil
+}
+
+// lintFiles checks master.m3u8 and the media playlists it references, read
+// with read. size returns the size of a media file.
+func lintFiles(read func(name string) ([]byte, error), size func(name string) (int64, error)) []error {
+	buf, err := read("master.m3u8")
+	if err != nil {
+		return []error{err}
+	}
+	res := lintMasterOrder(buf)
+
+	master := &MasterPlaylist{}
+	if err := master.parse(bytes.NewReader(buf)); err != nil {
+		return append(res, fmt.Errorf("master.m3u8: %w", err))
+	}
+
+	var playlists []*MediaPlaylist
+	for _, uri := range master.Playlists() {
+		buf, err := read(uri)
+		if err != nil {
+			return append(res, fmt.Errorf("%s: %w", uri, err))
+		}
+		pl := &MediaPlaylist{}
+		if err := pl.parse(bytes.NewReader(buf)); err != nil {
+			return append(res, fmt.Errorf("%s: %w", uri, err))
+		}
+		playlists = append(playlists, pl)
+	}
+
+	return append(res, lintPlaylists(master, playlists, size)...)
+}
+
+// lint checks the playlists generated by build, which still reference files
+// in hls.dir
+func (hls *hlsBuilder) lint(master *MasterPlaylist, playlists []*MediaPlaylist) error {
+	buf, err := master.Bytes()
+	if err != nil {
+		return err
+	}
+	errs := lintMasterOrder(buf)
+	errs = append(errs, lintPlaylists(master, playlists, hls.fileSize)...)
+	if len(errs) == 0 {
+		return nil
+	}
+	for _, err := range errs {
+		log.Printf("lint: %s", err)
+	}
+	return fmt.Errorf("%d problems found in generated playlists", len(errs))
+}
+
+// lintMasterOrder checks that rendition groups of the master playlist buf are
+// declared before variants reference them, as some players require. Groups
+// that are never declared are reported by lintPlaylists.
+func lintMasterOrder(buf []byte) []error {
+	var res []error
+	declared := make(map[string]bool)
+	var pending []string
+
+	m3u8Scan(bytes.NewReader(buf), func(spec *m3u8spec, uri string) error {
+		if spec == nil {
+			return nil
+		}
+		switch spec.key {
+		case "#EXT-X-MEDIA":
+			declared[spec.get("TYPE")+"/"+spec.get("GROUP-ID")] = true
+		case "#EXT-X-STREAM-INF", "#EXT-X-I-FRAME-STREAM-INF":
+			for _, typ := range []string{"AUDIO", "VIDEO", "SUBTITLES", "CLOSED-CAPTIONS"} {
+				g := spec.get(typ)
+				if g == "" || (typ == "CLOSED-CAPTIONS" && g == "NONE") {
+					continue
+				}
+				if !declared[typ+"/"+g] {
+					pending = append(pending, typ+"/"+g)
+				}
+			}
+		}
+		return nil
+	})
+
+	reported := make(map[string]bool)
+	for _, g := range pending {
+		if declared[g] && !reported[g] {
+			reported[g] = true
+			typ, id, _ := strings.Cut(g, "/")
+			res = append(res, fmt.Errorf("master.m3u8: %s group %q is referenced before being declared", typ, id))
+		}
+	}
+	return res
+}
+
+// lintPlaylists checks master and its media playlists, playlists[n] being the
+// playlist for master.Playlists()[n]. size returns the size of a media file
+// and is used to check declared bandwidths against measured bitrates.
+func lintPlaylists(master *MasterPlaylist, playlists []*MediaPlaylist, size func(name string) (int64, error)) []error {
+	var res []error
+	errorf := func(name, format string, args ...any) {
+		res = append(res, fmt.Errorf("%s: %s", name, fmt.Sprintf(format, args...)))
+	}
+
+	// renditions
+	groups := make(map[string][]*Rendition) // TYPE/GROUP-ID → renditions
+	for _, r := range master.Renditions {
+		name := fmt.Sprintf("master.m3u8: rendition %q", r.Name)
+		switch r.Type {
+		case "AUDIO", "VIDEO", "SUBTITLES", "CLOSED-CAPTIONS":
+		default:
+			errorf(name, "invalid TYPE %s", r.Type)
+		}
+		if r.Default && !r.AutoSelect {
+			errorf(name, "AUTOSELECT must be YES when DEFAULT is YES")
+		}
+		if r.Forced && r.Type != "SUBTITLES" {
+			errorf(name, "FORCED is only allowed for SUBTITLES")
+		}
+		if r.Type == "CLOSED-CAPTIONS" {
+			if r.InstreamID == "" {
+				errorf(name, "INSTREAM-ID is required for CLOSED-CAPTIONS")
+			}
+			if r.URI != "" {
+				errorf(name, "URI is not allowed for CLOSED-CAPTIONS")
+			}
+		} else if r.InstreamID != "" {
+			errorf(name, "INSTREAM-ID is only allowed for CLOSED-CAPTIONS")
+		}
+		if r.Type == "SUBTITLES" && r.URI == "" {
+			errorf(name, "URI is required for SUBTITLES")
+		}
+		if r.Channels != "" {
+			ch, _, _ := strings.Cut(r.Channels, "/")
+			if n, err := strconv.Atoi(ch); err != nil || n <= 0 {
+				errorf(name, "invalid CHANNELS %q", r.Channels)
+			}
+		}
+		if strings.HasPrefix(r.InstreamID, "SERVICE") && master.Version < 7 {
+			errorf(name, "INSTREAM-ID %s requires version 7, playlist has version %d", r.InstreamID, master.Version)
+		}
+
+		key := r.Type + "/" + r.GroupID
+		for _, o := range groups[key] {
+			if o.Name == r.Name {
+				errorf(name, "duplicate NAME in %s group %q", r.Type, r.GroupID)
+			}
+			if o.Default && r.Default {
+				errorf(name, "more than one DEFAULT rendition in %s group %q", r.Type, r.GroupID)
+			}
+		}
+		groups[key] = append(groups[key], r)
+	}
+
+	// variants
+	group := func(name, typ, id string) {
+		if id != "" && groups[typ+"/"+id] == nil {
+			errorf(name, "%s group %q is not declared", typ, id)
+		}
+	}
+	streamInf := func(name string, s *StreamInf) {
+		if s.Bandwidth == 0 {
+			errorf(name, "missing or zero BANDWIDTH")
+		}
+		if s.AverageBandwidth > s.Bandwidth {
+			errorf(name, "AVERAGE-BANDWIDTH %d is higher than BANDWIDTH %d", s.AverageBandwidth, s.Bandwidth)
+		}
+		if len(s.Codecs) == 0 {
+			errorf(name, "missing CODECS")
+		}
+		group(name, "VIDEO", s.Video)
+	}
+	noCC := 0
+	for _, v := range master.Variants {
+		name := "master.m3u8: variant " + v.URI
+		streamInf(name, &v.StreamInf)
+		group(name, "AUDIO", v.Audio)
+		group(name, "SUBTITLES", v.Subtitles)
+		if v.ClosedCaptions == "NONE" {
+			noCC += 1
+		} else {
+			group(name, "CLOSED-CAPTIONS", v.ClosedCaptions)
+		}
+	}
+	if noCC > 0 && noCC != len(master.Variants) {
+		errorf("master.m3u8", "CLOSED-CAPTIONS=NONE must be set on all variants or none")
+	}
+	for _, s := range master.IFrames {
+		streamInf("master.m3u8: I-frame stream "+s.URI, &s.StreamInf)
+	}
+
+	// media playlists
+	byURI := make(map[string]*MediaPlaylist)
+	for n, uri := range master.Playlists() {
+		if n >= len(playlists) {
+			break
+		}
+		byURI[uri] = playlists[n]
+		res = append(res, lintMedia(uri, playlists[n])...)
+	}
+
+	// measured bitrates
+	measure := func(name string, s *StreamInf) {
+		pl := byURI[s.URI]
+		if pl == nil || size == nil {
+			return
+		}
+		// segment URIs are relative to the media playlist
+		dir := path.Dir(s.URI)
+		peak, avg, err := measureBandwidth(pl, func(name string) (int64, error) {
+			return size(path.Join(dir, name))
+		})
+		if err != nil {
+			errorf(name, "%s", err)
+			return
+		}
+		if float64(peak) > float64(s.Bandwidth)*(1+lintTolerance) {
+			errorf(name, "measured peak bitrate %d exceeds BANDWIDTH %d", peak, s.Bandwidth)
+		}
+		if s.AverageBandwidth != 0 && float64(avg) > float64(s.AverageBandwidth)*(1+lintTolerance) {
+			errorf(name, "measured average bitrate %d exceeds AVERAGE-BANDWIDTH %d", avg, s.AverageBandwidth)
+		}
+	}
+	for _, v := range master.Variants {
+		measure("master.m3u8: variant "+v.URI, &v.StreamInf)
+	}
+	for _, s := range master.IFrames {
+		measure("master.m3u8: I-frame stream "+s.URI, &s.StreamInf)
+		if pl := byURI[s.URI]; pl != nil && !pl.IFramesOnly {
+			errorf(s.URI, "I-frame stream playlist without EXT-X-I-FRAMES-ONLY")
+		}
+	}
+
+	return res
+}
+
+// lintMedia checks the media playlist pl named name
+func lintMedia(name string, pl *MediaPlaylist) []error {
+	var res []error
+	errorf := func(format string, args ...any) {
+		res = append(res, fmt.Errorf("%s: %s", name, fmt.Sprintf(format, args...)))
+	}
+
+	if len(pl.Segments) == 0 {
+		errorf("no segments")
+	}
+	if pl.PlaylistType == "VOD" && !pl.EndList {
+		errorf("VOD playlist without EXT-X-ENDLIST")
+	}
+
+	// minimum version for the features used, see RFC 8216 section 7
+	version, feature := 1, ""
+	need := func(v int, f string) {
+		if v > version {
+			version, feature = v, f
+		}
+	}
+	if pl.IFramesOnly {
+		need(4, "EXT-X-I-FRAMES-ONLY")
+	}
+
+	for n, s := range pl.Segments {
+		if d := int(math.Round(s.Duration)); d > pl.TargetDuration {
+			errorf("segment %d (%s) duration %.3f exceeds EXT-X-TARGETDURATION %d", n, s.URI, s.Duration, pl.TargetDuration)
+		}
+		if s.Duration != math.Trunc(s.Duration) {
+			need(3, "floating point EXTINF durations")
+		}
+		if s.ByteRange != nil {
+			need(4, "EXT-X-BYTERANGE")
+		}
+		if s.Map != nil {
+			if pl.IFramesOnly {
+				need(5, "EXT-X-MAP")
+			} else {
+				need(6, "EXT-X-MAP")
+			}
+		}
+		if s.Key != nil {
+			if s.Key.IV != "" {
+				need(2, "EXT-X-KEY IV")
+			}
+			if s.Key.KeyFormat != "" || s.Key.KeyFormatVersions != "" {
+				need(5, "EXT-X-KEY KEYFORMAT")
+			}
+		}
+	}
+
+	if v := max(pl.Version, 1); v < version {
+		errorf("%s requires version %d, playlist has version %d", feature, version, v)
+	}
+	return res
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestLintMasterOrder(t *testing.T) {
+	src := `#EXTM3U
+#EXT-X-VERSION:6
+#EXT-X-STREAM-INF:BANDWIDTH=1000,CODECS="avc1.640028",SUBTITLES="subs"
+video.m3u8
+#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="subs",NAME="English",URI="subs.m3u8"
+`
+	errs := lintMasterOrder([]byte(src))
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "before being declared") {
+		t.Errorf("unexpected errors %v", errs)
+	}
+
+	// the typed model always writes renditions first
+	m := &MasterPlaylist{}
+	if err := m.parse(strings.NewReader(src)); err != nil {
+		t.Fatalf("failed to parse: %s", err)
+	}
+	buf, err := m.Bytes()
+	if err != nil {
+		t.Fatalf("failed to write: %s", err)
+	}
+	if errs := lintMasterOrder(buf); len(errs) != 0 {
+		t.Errorf("unexpected errors %v", errs)
+	}
+}
+
+func TestLintPlaylists(t *testing.T) {
+	m := &MasterPlaylist{Version: 6}
+	m.AddRendition("AUDIO", "audio", "main", "audio.m3u8").Default = true
+	v := m.AddVariant("video.m3u8", 1000)
+	v.Codecs = []string{"avc1.640028", "mp4a.40.2"}
+	v.Audio = "audio"
+
+	video := newVODPlaylist(6)
+	video.AddSegment("v.m4s", 6).Map = &MediaMap{URI: "v.mp4"}
+	audio := newVODPlaylist(6)
+	audio.AddSegment("a.m4s", 6).Map = &MediaMap{URI: "a.mp4"}
+
+	size := func(name string) (int64, error) {
+		switch name {
+		case "v.m4s":
+			return 600, nil // 800 bps
+		case "a.m4s":
+			return 60, nil
+		}
+		return 0, errors.New("not found")
+	}
+
+	if errs := lintPlaylists(m, []*MediaPlaylist{audio, video}, size); len(errs) != 0 {
+		t.Errorf("unexpected errors %v", errs)
+	}
+
+	// each problem must be reported
+	v.Bandwidth = 500
+	v.Codecs = nil
+	v.Subtitles = "subs"
+	video.Version = 3
+	video.TargetDuration = 5
+	errs := lintPlaylists(m, []*MediaPlaylist{audio, video}, size)
+	expect := []string{
+		"missing CODECS",
+		`SUBTITLES group "subs" is not declared`,
+		"exceeds EXT-X-TARGETDURATION 5",
+		"EXT-X-MAP requires version 6",
+		"measured peak bitrate 800 exceeds BANDWIDTH 500",
+	}
+	if len(errs) != len(expect) {
+		t.Errorf("expected %d errors, got %v", len(expect), errs)
+	}
+	for _, e := range expect {
+		found := false
+		for _, err := range errs {
+			found = found || strings.Contains(err.Error(), e)
+		}
+		if !found {
+			t.Errorf("missing error %q in %v", e, errs)
+		}
+	}
+}
+
+func TestLintTargetDuration(t *testing.T) {
+	// target duration is the rounded duration, a 10.4s segment fits in 10
+	pl := newVODPlaylist(6)
+	pl.AddSegment("a.vtt", 10.4)
+	pl.TargetDuration = 10
+	if errs := lintMedia("a.m3u8", pl); len(errs) != 0 {
+		t.Errorf("unexpected errors %v", errs)
+	}
+	pl.Segments[0].Duration = 10.6
+	if errs := lintMedia("a.m3u8", pl); len(errs) != 1 {
+		t.Errorf("expected 1 error, got %v", errs)
+	}
+
+	// subtitle playlists used to truncate the target duration
+	if errs := lintMedia("sub.m3u8", m3u8BuildVTT("sub.vtt", 10.6)); len(errs) != 0 {
+		t.Errorf("unexpected errors %v", errs)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"os/exec"
+	"strconv"
+
+	"github.com/KarpelesLab/ffprobe"
+	"github.com/KarpelesLab/hlsmaker/hlsfile"
+)
+
+var (
+	loudnormTarget = flag.Float64("loudnorm", 0, "normalize audio tracks to this integrated loudness in LUFS with EBU R128 two-pass loudnorm, such as -16 or -23 (0 to disable)")
+	loudnormPeak   = flag.Float64("loudnorm_tp", -1.5, "maximum true peak in dBTP of normalized audio")
+	loudnormRange  = flag.Float64("loudnorm_lra", 11, "target loudness range in LU of normalized audio")
+)
+
+// checkLoudnorm validates the loudnorm flags against the ranges ffmpeg accepts
+func checkLoudnorm() error {
+	if *loudnormTarget < -70 || *loudnormTarget > -5 {
+		return fmt.Errorf("loudnorm target %g LUFS out of range (-70 to -5)", *loudnormTarget)
+	}
+	if *loudnormPeak < -9 || *loudnormPeak > 0 {
+		return fmt.Errorf("loudnorm true peak %g dBTP out of range (-9 to 0)", *loudnormPeak)
+	}
+	if *loudnormRange < 1 || *loudnormRange > 20 {
+		return fmt.Errorf("loudnorm range %g LU out of range (1 to 20)", *loudnormRange)
+	}
+	return nil
+}
+
+// loudnessKey identifies a loudness measurement: a source audio track
+// downmixed to the number of channels of a rendition
+type loudnessKey struct {
+	index    int // source stream index
+	channels int
+}
+
+// downmixFilter returns the filter converting audio to the given number of
+// channels, so loudness is measured and normalized on the rendition layout
+func downmixFilter(channels int) string {
+	return fmt.Sprintf("aformat=channel_layouts=%dc", channels)
+}
+
+// measureLoudness runs the first loudnorm pass on each audio track for each
+// number of channels of its renditions, if not yet measured, storing results
+// in hls.loudness. Silent tracks are not normalized.
+func (hls *hlsBuilder) measureLoudness() error {
+	if hls.loudness == nil {
+		hls.loudness = make(map[loudnessKey]*hlsfile.LoudnessInfo)
+	}
+	for _, audio := range hls.audios {
+		for _, r := range hls.audioRungsFor(audio) {
+			k := loudnessKey{index: audio.Index, channels: r.channels()}
+			if _, ok := hls.loudness[k]; ok {
+				// already measured, for another rung or when retrying in software mode
+				continue
+			}
+			nfo, err := hls.measureTrackLoudness(k)
+			if err != nil {
+				return err
+			}
+			hls.loudness[k] = nfo
+		}
+	}
+	return nil
+}
+
+// measureTrackLoudness runs the first loudnorm pass on the track of k
+func (hls *hlsBuilder) measureTrackLoudness(k loudnessKey) (*hlsfile.LoudnessInfo, error) {
+	args := []string{"-hide_banner", "-nostats",
+		"-i", hls.input,
+		"-map", "0:" + strconv.Itoa(k.index),
+		"-af", downmixFilter(k.channels) + fmt.Sprintf(",loudnorm=I=%g:TP=%g:LRA=%g:print_format=json", *loudnormTarget, *loudnormPeak, *loudnormRange),
+		"-f", "null", os.DevNull,
+	}
+	if *verboseMode {
+		log.Printf("ffmpeg arguments: %v", args)
+	}
+	var stderr bytes.Buffer
+	c := exec.Command(exe("ffmpeg"), args...)
+	c.Dir = hls.dir // set to run in temp dir
+	c.Stderr = &stderr
+	if err := c.Run(); err != nil {
+		os.Stderr.Write(stderr.Bytes())
+		return nil, fmt.Errorf("loudness measurement of track #%d failed: %w", k.index, err)
+	}
+
+	nfo, err := parseLoudnorm(stderr.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("loudness measurement of track #%d: %w", k.index, err)
+	}
+	if nfo == nil {
+		log.Printf("loudness: track #%d is silent, not normalizing", k.index)
+		return nil, nil
+	}
+	log.Printf("loudness: track #%d (%d channels) integrated %.1f LUFS, true peak %.1f dBTP, range %.1f LU, gain %+.1f dB", k.index, k.channels, nfo.Integrated, nfo.TruePeak, nfo.Range, nfo.Gain)
+	if !nfo.Linear {
+		log.Printf("loudness: track #%d (%d channels) cannot reach the target within the true peak and range limits of loudnorm, applying a peak limited gain instead", k.index, k.channels)
+	}
+	return nfo, nil
+}
+
+// parseLoudnorm returns the measurements printed by the loudnorm filter with
+// print_format=json in the ffmpeg output out, or nil for silent audio
+func parseLoudnorm(out []byte) (*hlsfile.LoudnessInfo, error) {
+	// the json block is printed last
+	start, end := bytes.LastIndexByte(out, '{'), bytes.LastIndexByte(out, '}')
+	if start == -1 || end < start {
+		return nil, errors.New("no loudnorm output")
+	}
+	var res struct {
+		InputI       string `json:"input_i"`
+		InputTP      string `json:"input_tp"`
+		InputLRA     string `json:"input_lra"`
+		InputThresh  string `json:"input_thresh"`
+		TargetOffset string `json:"target_offset"`
+	}
+	if err := json.Unmarshal(out[start:end+1], &res); err != nil {
+		return nil, fmt.Errorf("invalid loudnorm output: %w", err)
+	}
+
+	var vals [5]float64
+	for n, s := range []string{res.InputI, res.InputTP, res.InputLRA, res.InputThresh, res.TargetOffset} {
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid loudnorm value %q: %w", s, err)
+		}
+		if math.IsInf(v, 0) || math.IsNaN(v) {
+			// silence
+			return nil, nil
+		}
+		vals[n] = v
+	}
+
+	nfo := &hlsfile.LoudnessInfo{
+		Integrated: vals[0],
+		TruePeak:   vals[1],
+		Range:      vals[2],
+		Threshold:  vals[3],
+		Offset:     vals[4],
+		Target:     *loudnormTarget,
+	}
+	// conditions for ffmpeg to keep linear mode, otherwise it silently
+	// switches to dynamic normalization
+	nfo.Gain = nfo.Target - nfo.Integrated
+	nfo.Linear = nfo.TruePeak+nfo.Gain <= *loudnormPeak && nfo.Range <= *loudnormRange
+	if !nfo.Linear {
+		// plain gain, reduced to keep the true peak within the limit
+		nfo.Gain = math.Round(min(nfo.Gain, *loudnormPeak-nfo.TruePeak)*100) / 100
+	}
+	return nfo, nil
+}
+
+// loudnormFilter returns the second pass filter for the source track src
+// downmixed to channels, measured as nfo. This is loudnorm in linear mode when
+// possible, otherwise the peak limited gain of nfo. loudnorm outputs 192 kHz,
+// so the result is resampled to the source rate.
+func loudnormFilter(nfo *hlsfile.LoudnessInfo, src *ffprobe.Stream, channels int) string {
+	if !nfo.Linear {
+		return fmt.Sprintf("%s,volume=%.2fdB", downmixFilter(channels), nfo.Gain)
+	}
+	rate := src.SampleRate
+	if rate <= 0 || rate > 48000 {
+		rate = 48000
+	}
+	return fmt.Sprintf("%s,loudnorm=I=%g:TP=%g:LRA=%g:measured_I=%.2f:measured_TP=%.2f:measured_LRA=%.2f:measured_thresh=%.2f:offset=%.2f:linear=true,aresample=%d",
+		downmixFilter(channels), nfo.Target, *loudnormPeak, *loudnormRange,
+		nfo.Integrated, nfo.TruePeak, nfo.Range, nfo.Threshold, nfo.Offset, rate)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/KarpelesLab/ffprobe"
+)
+
+const loudnormOutput = `Input #0, mov,mp4,m4a,3gp,3g2,mj2, from 'input.mp4':
+  Duration: 00:01:40.00, start: 0.000000, bitrate: 3000 kb/s
+[Parsed_loudnorm_0 @ 0x5581c0a3f2c0] 
+{
+	"input_i" : "-27.61",
+	"input_tp" : "-9.40",
+	"input_lra" : "6.10",
+	"input_thresh" : "-37.95",
+	"output_i" : "-16.02",
+	"output_tp" : "-1.50",
+	"output_lra" : "5.20",
+	"output_thresh" : "-26.30",
+	"normalization_type" : "dynamic",
+	"target_offset" : "0.02"
+}
+`
+
+func TestLoudnorm(t *testing.T) {
+	*loudnormTarget = -16
+	defer func() { *loudnormTarget = 0 }()
+
+	nfo, err := parseLoudnorm([]byte(loudnormOutput))
+	if err != nil {
+		t.Fatalf("failed to parse loudnorm output: %s", err)
+	}
+	if nfo.Integrated != -27.61 || nfo.TruePeak != -9.4 || nfo.Range != 6.1 || nfo.Threshold != -37.95 || nfo.Offset != 0.02 {
+		t.Errorf("unexpected measurements %+v", nfo)
+	}
+	// +11.61 dB would bring the true peak to 2.21 dBTP, so the gain is
+	// limited to reach -1.5 dBTP
+	if nfo.Linear || nfo.Gain != 7.9 {
+		t.Errorf("expected a peak limited gain, got %+v", nfo)
+	}
+	if flt := loudnormFilter(nfo, &ffprobe.Stream{SampleRate: 44100}, 2); flt != "aformat=channel_layouts=2c,volume=7.90dB" {
+		t.Errorf("unexpected filter %s", flt)
+	}
+
+	linear := strings.Replace(loudnormOutput, `"-27.61"`, `"-20.00"`, 1)
+	nfo, err = parseLoudnorm([]byte(linear))
+	if err != nil || !nfo.Linear || nfo.Gain != 4 {
+		t.Fatalf("expected linear normalization, got %+v (%v)", nfo, err)
+	}
+	flt := loudnormFilter(nfo, &ffprobe.Stream{SampleRate: 44100}, 6)
+	if flt != "aformat=channel_layouts=6c,loudnorm=I=-16:TP=-1.5:LRA=11:measured_I=-20.00:measured_TP=-9.40:measured_LRA=6.10:measured_thresh=-37.95:offset=0.02:linear=true,aresample=44100" {
+		t.Errorf("unexpected filter %s", flt)
+	}
+
+	silent := strings.NewReplacer(`"-27.61"`, `"-inf"`, `"-9.40"`, `"-inf"`).Replace(loudnormOutput)
+	if nfo, err := parseLoudnorm([]byte(silent)); err != nil || nfo != nil {
+		t.Errorf("expected nil for silence, got %+v (%v)", nfo, err)
+	}
+	if _, err := parseLoudnorm([]byte("Error opening input")); err == nil {
+		t.Errorf("expected error without loudnorm output")
+	}
+}
@@ -3,285 +3,341 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
-	"io/fs"
-	"log"
-	"os"
+	"slices"
 	"strconv"
 	"strings"
 )
 
-type m3u8 struct {
-	headers []*m3u8spec
-	files   []*m3u8file
-	footer  []string
-}
-
-type m3u8file struct {
-	headers    []*m3u8spec
-	standalone bool
-	filename   string
-}
-
+// m3u8spec is a tag line, such as #EXT-X-VERSION:6 or
+// #EXT-X-MEDIA:TYPE=AUDIO,URI="..."
 type m3u8spec struct {
-	key  string   // EXT-X-MEDIA
-	vars []string // TYPE=AUDIO, URI="...", etc
+	key   string      // #EXT-X-MEDIA
+	value string      // value of tags without attribute list, such as "6" for #EXT-X-VERSION
+	attrs []*m3u8attr // attribute list, such as TYPE=AUDIO,URI="..."
+	err   error       // first error of the typed setters
 }
 
-func m3u8Parse(fn string) (*m3u8, error) {
-	log.Printf("m3u8: parsing %s", fn)
-
-	f, err := os.Open(fn)
-	if err != nil {
-		return nil, err
-	}
-	defer f.Close()
-
-	res := &m3u8{}
-	return res, res.parse(f)
+// m3u8attr is an attribute of an attribute list
+type m3u8attr struct {
+	name  string
+	value string // as written, including quotes for quoted strings
 }
 
-func m3u8BuildVTT(fn string, duration float64) *m3u8 {
-	f := &m3u8{
-		headers: []*m3u8spec{
-			&m3u8spec{key: "#EXTM3U"},
-			&m3u8spec{key: "#EXT-X-VERSION", vars: []string{"6"}},
-			&m3u8spec{key: "#EXT-X-ALLOW-CACHE", vars: []string{"YES"}},
-			&m3u8spec{key: "#EXT-X-TARGETDURATION", vars: []string{strconv.FormatUint(uint64(duration), 10)}},
-			&m3u8spec{key: "#EXT-X-MEDIA-SEQUENCE", vars: []string{"0"}},
-			&m3u8spec{key: "#EXT-X-PLAYLIST-TYPE", vars: []string{"VOD"}},
-		},
-		files: []*m3u8file{
-			&m3u8file{
-				headers: []*m3u8spec{
-					&m3u8spec{key: "#EXTINF", vars: []string{strconv.FormatFloat(duration, 'f', 6, 64), ""}},
-				},
-				standalone: true,
-				filename:   fn,
-			},
-		},
-		footer: []string{"#EXT-X-ENDLIST"},
-	}
-
-	return f
+// m3u8attrTags lists the tags which take an attribute list, see RFC 8216
+var m3u8attrTags = map[string]bool{
+	"#EXT-X-KEY":                true,
+	"#EXT-X-MAP":                true,
+	"#EXT-X-DATERANGE":          true,
+	"#EXT-X-MEDIA":              true,
+	"#EXT-X-STREAM-INF":         true,
+	"#EXT-X-I-FRAME-STREAM-INF": true,
+	"#EXT-X-SESSION-DATA":       true,
+	"#EXT-X-SESSION-KEY":        true,
+	"#EXT-X-START":              true,
+	"#EXT-X-DEFINE":             true,
+	"#EXT-X-PART":               true,
+	"#EXT-X-PART-INF":           true,
+	"#EXT-X-PRELOAD-HINT":       true,
+	"#EXT-X-RENDITION-REPORT":   true,
+	"#EXT-X-SERVER-CONTROL":     true,
+	"#EXT-X-SKIP":               true,
+	"#EXT-X-CONTENT-STEERING":   true,
 }
 
-func (m *m3u8) parse(in io.Reader) error {
+// m3u8Scan reads the lines of a playlist, calling cb with the parsed tag or
+// the URI of each non empty line. Errors are returned with the line number.
+func m3u8Scan(in io.Reader, cb func(spec *m3u8spec, uri string) error) error {
 	r := bufio.NewReader(in)
-	var f *m3u8file
+	lineNo := 0
 
 	for {
 		ln, err := r.ReadString('\n')
-		if err != nil {
-			if err == io.EOF {
-				if f != nil {
-					return io.ErrUnexpectedEOF
-				}
-				return nil
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if err == io.EOF && ln == "" {
+			if lineNo == 0 {
+				return errors.New("m3u8: empty playlist")
 			}
+			return nil
 		}
 		ln = strings.TrimSpace(ln)
 		if ln == "" {
 			// remove empty lines
 			continue
 		}
-		spec := m3u8specParse(ln)
-
-		if spec.key == "#EXT-X-STREAM-INF" || spec.key == "#EXTINF" {
-			// we're now in a file
-			if f != nil {
-				return fmt.Errorf("unexpected %s", ln)
-			}
-			f = &m3u8file{
-				headers: []*m3u8spec{spec},
-			}
-			continue
-		}
-		if spec.key == "#EXT-X-MEDIA" || spec.key == "#EXT-X-I-FRAME-STREAM-INF" {
-			// #EXT-X-MEDIA:TYPE=AUDIO,URI="stream_2.m3u8",GROUP-ID="default-audio-group",LANGUAGE="ja",NAME="stream_2",DEFAULT=NO,AUTOSELECT=YES,CHANNELS="2"
-			// #EXT-X-I-FRAME-STREAM-INF:BANDWIDTH=321394,AVERAGE-BANDWIDTH=115404,CODECS="avc1.42c028",RESOLUTION=1920x1080,CLOSED-CAPTIONS=NONE,URI="stream_0_iframe.m3u8"
-			f := &m3u8file{
-				headers:  []*m3u8spec{spec},
-				filename: spec.get("URI"),
+		lineNo += 1
+		if lineNo == 1 {
+			if ln != "#EXTM3U" {
+				return fmt.Errorf("m3u8: line 1: expected #EXTM3U, got %q", ln)
 			}
-			m.files = append(m.files, f)
 			continue
 		}
-		if ln == "#EXT-X-ENDLIST" {
-			m.footer = append(m.footer, ln)
-			continue
-		}
-		if ln[0] != '#' {
-			// filename
-			if f == nil {
-				return fmt.Errorf("unexpected %s", ln)
-			}
-			f.filename = ln
-			f.standalone = true
-			m.files = append(m.files, f)
-			f = nil
-			continue
-		}
-		if f == nil {
-			if len(m.files) != 0 {
-				return fmt.Errorf("unexpected %s", ln)
+
+		var spec *m3u8spec
+		var uri string
+		if ln[0] == '#' {
+			spec, err = m3u8specParse(ln)
+			if err != nil {
+				return fmt.Errorf("m3u8: line %d: %w", lineNo, err)
 			}
-			m.headers = append(m.headers, spec)
 		} else {
-			f.headers = append(f.headers, spec)
+			uri = ln
+		}
+		if err := cb(spec, uri); err != nil {
+			return fmt.Errorf("m3u8: line %d: %w", lineNo, err)
 		}
 	}
 }
 
-func (m *m3u8) SaveAs(fn string) error {
-	f, err := os.Create(fn)
-	if err != nil {
-		return err
+// m3u8specParse parses a tag line such as #EXT-X-MEDIA:TYPE=AUDIO,URI="..."
+func m3u8specParse(ln string) (*m3u8spec, error) {
+	if !strings.HasPrefix(ln, "#EXT") {
+		// comment
+		return &m3u8spec{key: ln}, nil
 	}
-	defer f.Close()
 
-	_, err = m.WriteTo(f)
-	return err
-}
+	key, value, ok := strings.Cut(ln, ":")
+	res := &m3u8spec{key: key}
+	if !ok {
+		return res, nil
+	}
+	if !m3u8attrTags[key] {
+		res.value = value
+		return res, nil
+	}
 
-func (m *m3u8) Bytes() []byte {
-	buf := &bytes.Buffer{}
-	m.WriteTo(buf)
-	return buf.Bytes()
+	attrs, err := m3u8attrsParse(value)
+	if err != nil {
+		return nil, fmt.Errorf("in %s: %w", key, err)
+	}
+	res.attrs = attrs
+	return res, nil
 }
 
-func (m *m3u8) takeFile(fn string) (f *m3u8file, err error) {
-	for n, f := range m.files {
-		if f.filename == fn {
-			// remove it from files
-			m.files = append(m.files[:n], m.files[n+1:]...)
-			return f, nil
+// m3u8attrsParse parses an attribute list as defined in RFC 8216 section 4.2
+func m3u8attrsParse(s string) ([]*m3u8attr, error) {
+	var res []*m3u8attr
+	seen := make(map[string]bool)
+
+	for {
+		name, rest, ok := strings.Cut(s, "=")
+		if !ok {
+			return nil, fmt.Errorf("missing value for attribute %q", s)
+		}
+		if !m3u8validName(name) {
+			return nil, fmt.Errorf("invalid attribute name %q", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("duplicate attribute %s", name)
+		}
+		seen[name] = true
+
+		var value string
+		if strings.HasPrefix(rest, "\"") {
+			end := strings.IndexByte(rest[1:], '"')
+			if end == -1 {
+				return nil, fmt.Errorf("unterminated quoted string for attribute %s", name)
+			}
+			value, rest = rest[:end+2], rest[end+2:]
+		} else {
+			end := strings.IndexByte(rest, ',')
+			if end == -1 {
+				end = len(rest)
+			}
+			value, rest = rest[:end], rest[end:]
+			if value == "" {
+				return nil, fmt.Errorf("empty value for attribute %s", name)
+			}
+			if strings.ContainsAny(value, "\" \t") {
+				return nil, fmt.Errorf("invalid value %q for attribute %s", value, name)
+			}
+		}
+		res = append(res, &m3u8attr{name: name, value: value})
+
+		if rest == "" {
+			return res, nil
+		}
+		if rest[0] != ',' {
+			return nil, fmt.Errorf("unexpected %q after value of attribute %s", rest, name)
+		}
+		s = rest[1:]
+		if s == "" {
+			return nil, errors.New("trailing comma in attribute list")
 		}
 	}
-	return nil, fs.ErrNotExist
 }
 
-func (m *m3u8) WriteTo(w io.Writer) (n int64, err error) {
-	var n2 int
-	var n3 int64
-	for _, h := range m.headers {
-		n2, err = w.Write([]byte(h.String() + "\n"))
-		n += int64(n2)
-		if err != nil {
-			return
-		}
+// m3u8validName returns true if name is a valid attribute name
+func m3u8validName(name string) bool {
+	if name == "" {
+		return false
 	}
-	for _, f := range m.files {
-		n3, err = f.WriteTo(w)
-		n += n3
-		if err != nil {
-			return
+	for _, c := range name {
+		if (c < 'A' || c > 'Z') && (c < '0' || c > '9') && c != '-' {
+			return false
 		}
 	}
-	for _, ln := range m.footer {
-		n2, err = w.Write([]byte(ln + "\n"))
-		n += int64(n2)
-		if err != nil {
-			return
+	return true
+}
+
+func (spec *m3u8spec) attr(k string) *m3u8attr {
+	for _, a := range spec.attrs {
+		if a.name == k {
+			return a
 		}
 	}
-	return
+	return nil
 }
 
-func (f *m3u8file) WriteTo(w io.Writer) (n int64, err error) {
-	var n2 int
-	for _, h := range f.headers {
-		n2, err = w.Write([]byte(h.String() + "\n"))
-		n += int64(n2)
-		if err != nil {
-			return
-		}
+// get returns the value of attribute k, without quotes for quoted strings,
+// or an empty string if not set
+func (spec *m3u8spec) get(k string) string {
+	a := spec.attr(k)
+	if a == nil {
+		return ""
 	}
-	if f.standalone {
-		n2, err = w.Write([]byte(f.filename + "\n"))
-		n += int64(n2)
+	return strings.TrimSuffix(strings.TrimPrefix(a.value, "\""), "\"")
+}
+
+// getEnum returns the value of enumerated-string attribute k, or an empty
+// string if not set
+func (spec *m3u8spec) getEnum(k string) (string, error) {
+	a := spec.attr(k)
+	if a == nil {
+		return "", nil
 	}
-	return
+	if strings.HasPrefix(a.value, "\"") {
+		return "", fmt.Errorf("%s: invalid enumerated string %s=%s", spec.key, k, a.value)
+	}
+	return a.value, nil
 }
 
-func (f *m3u8file) setFilename(fn string) {
-	f.filename = fn
-	if !f.standalone {
-		// header 0 ?
-		f.headers[0].set("URI", "\""+fn+"\"")
+// getInt returns the value of decimal-integer attribute k
+func (spec *m3u8spec) getInt(k string) (uint64, error) {
+	a := spec.attr(k)
+	if a == nil {
+		return 0, fmt.Errorf("%s: missing attribute %s", spec.key, k)
 	}
+	res, err := strconv.ParseUint(a.value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s: invalid integer %s=%s", spec.key, k, a.value)
+	}
+	return res, nil
 }
 
-func m3u8specParse(f string) *m3u8spec {
-	// #AAA:X=A,Y=B,Z=C
+// getFloat returns the value of decimal-floating-point attribute k
+func (spec *m3u8spec) getFloat(k string) (float64, error) {
+	a := spec.attr(k)
+	if a == nil {
+		return 0, fmt.Errorf("%s: missing attribute %s", spec.key, k)
+	}
+	res, err := strconv.ParseFloat(a.value, 64)
+	if err != nil || strings.HasPrefix(a.value, "\"") {
+		return 0, fmt.Errorf("%s: invalid number %s=%s", spec.key, k, a.value)
+	}
+	return res, nil
+}
 
-	pos := strings.IndexByte(f, ':')
-	if pos == -1 {
-		return &m3u8spec{key: f}
+// getResolution returns the value of decimal-resolution attribute k
+func (spec *m3u8spec) getResolution(k string) (int, int, error) {
+	a := spec.attr(k)
+	if a == nil {
+		return 0, 0, fmt.Errorf("%s: missing attribute %s", spec.key, k)
+	}
+	w, h, ok := strings.Cut(a.value, "x")
+	wi, err1 := strconv.ParseUint(w, 10, 31)
+	hi, err2 := strconv.ParseUint(h, 10, 31)
+	if !ok || err1 != nil || err2 != nil {
+		return 0, 0, fmt.Errorf("%s: invalid resolution %s=%s", spec.key, k, a.value)
 	}
+	return int(wi), int(hi), nil
+}
 
-	res := &m3u8spec{key: f[:pos]}
-	f = f[pos+1:]
+// set sets attribute k to the raw value v, which must already be quoted if
+// needed. Prefer the typed setters.
+func (spec *m3u8spec) set(k, v string) {
+	if a := spec.attr(k); a != nil {
+		a.value = v
+		return
+	}
+	// append
+	spec.attrs = append(spec.attrs, &m3u8attr{name: k, value: v})
+}
 
-	// TODO handle quotes "..."
+// setString sets quoted-string attribute k. Characters that cannot appear in
+// a quoted string (double quotes and line breaks) are replaced.
+func (spec *m3u8spec) setString(k, v string) {
+	v = strings.NewReplacer("\"", "'", "\r", " ", "\n", " ").Replace(v)
+	spec.set(k, "\""+v+"\"")
+}
 
-	for {
-		pos = strings.IndexByte(f, ',')
-		if pos == -1 {
-			// last
-			if f != "" {
-				res.vars = append(res.vars, f)
-			}
-			break
+// setEnum sets enumerated-string attribute k, such as TYPE=AUDIO. An empty
+// or invalid value is not set, and recorded as the error of spec.
+func (spec *m3u8spec) setEnum(k, v string) {
+	if v == "" || strings.ContainsAny(v, "\", \t\r\n") {
+		if spec.err == nil {
+			spec.err = fmt.Errorf("%s: invalid enumerated string %s=%q", spec.key, k, v)
 		}
-		res.vars = append(res.vars, f[:pos])
-		f = f[pos+1:]
+		return
 	}
+	spec.set(k, v)
+}
 
-	return res
+// setInt sets decimal-integer attribute k
+func (spec *m3u8spec) setInt(k string, v uint64) {
+	spec.set(k, strconv.FormatUint(v, 10))
 }
 
-func (spec *m3u8spec) get(k string) string {
-	pfx := k + "="
-	for _, s := range spec.vars {
-		if strings.HasPrefix(s, pfx) {
-			res := s[len(pfx):]
-			if res[0] == '"' {
-				res = strings.Trim(res, "\"")
-			}
-			return res
-		}
-	}
-	return ""
+// setFloat sets decimal-floating-point attribute k with 3 decimals
+func (spec *m3u8spec) setFloat(k string, v float64) {
+	spec.set(k, strconv.FormatFloat(v, 'f', 3, 64))
 }
 
-func (spec *m3u8spec) set(k, v string) {
-	pfx := k + "="
-	for n, s := range spec.vars {
-		if strings.HasPrefix(s, pfx) {
-			spec.vars[n] = pfx + v
-			return
-		}
-	}
-	// append
-	spec.vars = append(spec.vars, pfx+v)
+// setResolution sets decimal-resolution attribute k
+func (spec *m3u8spec) setResolution(k string, w, h int) {
+	spec.set(k, fmt.Sprintf("%dx%d", w, h))
 }
 
 func (spec *m3u8spec) String() string {
 	buf := &bytes.Buffer{}
 	buf.WriteString(spec.key)
-	if len(spec.vars) == 0 {
+	if len(spec.attrs) == 0 {
+		if spec.value != "" {
+			buf.WriteByte(':')
+			buf.WriteString(spec.value)
+		}
 		return buf.String()
 	}
 
 	buf.WriteByte(':')
 
-	for n, v := range spec.vars {
+	for n, a := range spec.attrs {
 		if n != 0 {
 			buf.WriteByte(',')
 		}
-		buf.WriteString(v)
+		buf.WriteString(a.name)
+		buf.WriteByte('=')
+		buf.WriteString(a.value)
 	}
 	return buf.String()
 }
+
+// has returns true if attribute k is set
+func (spec *m3u8spec) has(k string) bool {
+	return spec.attr(k) != nil
+}
+
+// other returns the attributes of spec not listed in known
+func (spec *m3u8spec) other(known ...string) []*m3u8attr {
+	var res []*m3u8attr
+	for _, a := range spec.attrs {
+		if !slices.Contains(known, a.name) {
+			res = append(res, a)
+		}
+	}
+	return res
+}
@@ -0,0 +1,76 @@
+package main
+
+import "testing"
+
+func TestM3U8Attributes(t *testing.T) {
+	spec, err := m3u8specParse(`#EXT-X-STREAM-INF:BANDWIDTH=2000000,CODECS="avc1.640028,mp4a.40.2",RESOLUTION=1920x1080,FRAME-RATE=29.970,NAME=""`)
+	if err != nil {
+		t.Fatalf("failed to parse: %s", err)
+	}
+	if len(spec.attrs) != 5 {
+		t.Errorf("expected 5 attributes, got %d", len(spec.attrs))
+	}
+	if v := spec.get("CODECS"); v != "avc1.640028,mp4a.40.2" {
+		t.Errorf("unexpected CODECS %q", v)
+	}
+	if v := spec.get("NAME"); v != "" {
+		t.Errorf("unexpected NAME %q", v)
+	}
+	if v := spec.get("MISSING"); v != "" {
+		t.Errorf("unexpected MISSING %q", v)
+	}
+	if v, err := spec.getInt("BANDWIDTH"); err != nil || v != 2000000 {
+		t.Errorf("unexpected BANDWIDTH %d (err=%v)", v, err)
+	}
+	if v, err := spec.getFloat("FRAME-RATE"); err != nil || v != 29.97 {
+		t.Errorf("unexpected FRAME-RATE %f (err=%v)", v, err)
+	}
+	if w, h, err := spec.getResolution("RESOLUTION"); err != nil || w != 1920 || h != 1080 {
+		t.Errorf("unexpected RESOLUTION %dx%d (err=%v)", w, h, err)
+	}
+	if _, err := spec.getInt("CODECS"); err == nil {
+		t.Errorf("expected error reading CODECS as integer")
+	}
+
+	spec = &m3u8spec{key: "#EXT-X-MEDIA"}
+	spec.setEnum("TYPE", "AUDIO")
+	spec.setString("NAME", "say \"hi\"\n")
+	spec.setInt("BANDWIDTH", 1000)
+	spec.setString("NAME", "a, b")
+	if s := spec.String(); s != `#EXT-X-MEDIA:TYPE=AUDIO,NAME="a, b",BANDWIDTH=1000` {
+		t.Errorf("unexpected %s", s)
+	}
+	spec.setString("NAME", "say \"hi\"\n")
+	if v := spec.get("NAME"); v != "say 'hi' " {
+		t.Errorf("unexpected sanitized NAME %q", v)
+	}
+	if spec.err != nil {
+		t.Errorf("unexpected error %s", spec.err)
+	}
+
+	for _, v := range []string{"", "PQ HLG", "\"SDR\"", "A,B"} {
+		spec = &m3u8spec{key: "#EXT-X-STREAM-INF"}
+		spec.setEnum("VIDEO-RANGE", v)
+		if spec.err == nil || spec.has("VIDEO-RANGE") {
+			t.Errorf("expected error setting VIDEO-RANGE to %q", v)
+		}
+	}
+}
+
+func TestM3U8Errors(t *testing.T) {
+	invalid := []string{
+		`#EXT-X-MEDIA:TYPE=AUDIO,NAME="unterminated`,
+		`#EXT-X-MEDIA:TYPE=AUDIO,NAME="x"y`,
+		`#EXT-X-MEDIA:TYPE=,NAME="x"`,
+		`#EXT-X-MEDIA:TYPE=AUDIO,`,
+		`#EXT-X-MEDIA:TYPE`,
+		`#EXT-X-MEDIA:type=AUDIO`,
+		`#EXT-X-MEDIA:TYPE=AUDIO,TYPE=VIDEO`,
+		`#EXT-X-MEDIA:TYPE=AU DIO`,
+	}
+	for _, ln := range invalid {
+		if _, err := m3u8specParse(ln); err == nil {
+			t.Errorf("expected error parsing %s", ln)
+		}
+	}
+}
@@ -12,12 +12,39 @@ var (
 	outputFile = flag.String("out", "", "output file")
 )
 
+// commands can be invoked as: hlsmaker <command> [flags] args...
+var commands = map[string]func(args []string) error{
+	"serve":   serveCommand,
+	"inspect": inspectCommand,
+	"extract": extractCommand,
+	"verify":  verifyCommand,
+	"lint":    lintCommand,
+	"ladder":  ladderCommand,
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			flag.CommandLine.Parse(os.Args[2:])
+			if err := cmd(flag.Args()); err != nil {
+				log.Printf("%s: %s", os.Args[1], err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
 	flag.Parse()
 
 	// take input video file (as param to ffmpeg or ffprobe) and generate a video file
 	if inputFile == nil || *inputFile == "" {
 		log.Printf("Syntax: %s -in filename [-key key]", os.Args[0])
+		log.Printf("    or: %s serve [-listen addr] file.hls", os.Args[0])
+		log.Printf("    or: %s inspect [-json] file.hls", os.Args[0])
+		log.Printf("    or: %s extract file.hls directory", os.Args[0])
+		log.Printf("    or: %s verify [-probe] file.hls", os.Args[0])
+		log.Printf("    or: %s lint file.hls|directory", os.Args[0])
+		log.Printf("    or: %s ladder [-ladder profile.json] [WxH]", os.Args[0])
 		flag.PrintDefaults()
 		os.Exit(1)
 		return
@@ -37,7 +64,12 @@ func main() {
 
 	out := *outputFile
 	if out == "" {
-		out = inFile + ".hls"
+		switch *outputFormat {
+		case "dir":
+			out = inFile + "_hls"
+		default:
+			out = inFile + ".hls"
+		}
 	}
 
 	hlsb, err := newHlsBuilder(out)
@@ -62,6 +94,15 @@ func main() {
 		return
 	}
 
+	if qualityEnabled() {
+		err = hlsb.measureVariantsQuality()
+		if err != nil {
+			log.Printf("quality check failed: %s", err)
+			os.Exit(1)
+			return
+		}
+	}
+
 	err = hlsb.build()
 	if err != nil {
 		log.Printf("failed to build hls: %s", err)
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"flag"
+	"math"
+	"runtime/debug"
+	"time"
+
+	"github.com/KarpelesLab/ffprobe"
+	"github.com/KarpelesLab/hlsmaker/hlsfile"
+)
+
+var (
+	writeMetadata = flag.Bool("metadata", false, "include json metadata in the output (always included with -loudnorm and -per_title)")
+)
+
+// metadataEnabled returns true if metadata is included in the output, with
+// -metadata or with -loudnorm and -per_title as their measurements and
+// decisions are recorded in it
+func metadataEnabled() bool {
+	return *writeMetadata || *loudnormTarget != 0 || *perTitle
+}
+
+// hlsmakerVersion returns the version of hlsmaker as recorded by the go toolchain
+func hlsmakerVersion() string {
+	nfo, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	res := nfo.Main.Version
+	for _, s := range nfo.Settings {
+		if s.Key == "vcs.revision" {
+			res += " (" + s.Value + ")"
+		}
+	}
+	return res
+}
+
+// metadata returns the metadata describing the source and encoding settings
+func (hls *hlsBuilder) metadata() *hlsfile.Metadata {
+	res := &hlsfile.Metadata{
+		Version: hlsmakerVersion(),
+		Created: time.Now(),
+		Source: &hlsfile.SourceInfo{
+			Format:   hls.info.Format.FormatName,
+			Duration: hls.info.Format.Duration,
+			Size:     hls.info.Format.Size,
+			BitRate:  hls.info.Format.BitRate,
+			Tags:     hls.info.Format.Tags,
+		},
+		Encoder: &hlsfile.EncoderInfo{
+			Software:  *softwareMode,
+			Fast:      *fastEncode,
+			Filters:   *videoFilters,
+			Ladder:    *ladderFile,
+			FrameRate: hls.frameRate(),
+		},
+		Complexity: hls.complexity,
+	}
+
+	for _, c := range hls.info.Chapters {
+		res.Source.Chapters = append(res.Source.Chapters, &hlsfile.ChapterInfo{Start: c.StartTime, End: c.EndTime, Title: c.Tags["title"]})
+	}
+
+	// list source streams actually used
+	streams := append([]*ffprobe.Stream{hls.video}, hls.audios...)
+	streams = append(streams, hls.subtitles...)
+	for _, s := range streams {
+		nfo := &hlsfile.StreamInfo{
+			Index:      s.Index,
+			Type:       s.CodecType,
+			Codec:      s.CodecName,
+			Profile:    s.Profile,
+			Width:      s.Width,
+			Height:     s.Height,
+			SampleRate: s.SampleRate,
+			Language:   s.Tags["language"],
+			Title:      s.Tags["title"],
+		}
+		if rate := s.FrameRate.Value(); s == hls.video && !math.IsNaN(rate) {
+			nfo.FrameRate = rate
+		}
+		res.Source.Streams = append(res.Source.Streams, nfo)
+	}
+
+	res.Variants = hls.variantInfo()
+
+	for _, ts := range hls.streams {
+		r := ts.audio
+		if r == nil {
+			continue
+		}
+		nfo := &hlsfile.AudioInfo{
+			Index:    ts.src.Index,
+			Codec:    r.Codec,
+			Bitrate:  r.bitrate(),
+			Channels: r.channels(),
+			Group:    r.groupID(),
+			Language: ts.src.Tags["language"],
+			Loudness: hls.loudness[loudnessKey{index: ts.src.Index, channels: r.channels()}],
+		}
+		if ts.passthrough {
+			nfo.Bitrate = hls.track(ts.src).BitRate
+			nfo.Passthrough = true
+		}
+		res.Audio = append(res.Audio, nfo)
+	}
+
+	return res
+}
+
+// variantInfo returns the description of each video variant
+func (hls *hlsBuilder) variantInfo() []*hlsfile.VariantInfo {
+	var res []*hlsfile.VariantInfo
+	for _, v := range hls.variants {
+		nfo := &hlsfile.VariantInfo{
+			Codec:       v.codec.String(),
+			Width:       v.size.w,
+			Height:      v.size.h,
+			Bitrate:     v.bitrate(hls.frameRate()),
+			RateControl: v.settings().rateControl(),
+			Quality:     v.quality,
+		}
+		switch nfo.RateControl {
+		case "crf":
+			nfo.CRF = v.crf()
+			nfo.MaxRate = v.maxRate(hls.frameRate())
+		case "vbr":
+			nfo.MaxRate = v.maxRate(hls.frameRate())
+		}
+		res = append(res, nfo)
+	}
+	return res
+}
@@ -0,0 +1,158 @@
+// Package mp4 implements the minimal ISO BMFF support needed to turn regular
+// single track mp4 files as produced by ffmpeg into fragmented mp4 (CMAF)
+// init and media segments.
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var ErrInvalid = errors.New("mp4: invalid file")
+
+// Box is a parsed mp4 box. Container boxes have Children, other boxes have
+// their payload in Data, except for mdat boxes which are not loaded.
+type Box struct {
+	Type     string
+	Data     []byte
+	Children []*Box
+
+	Offset int64 // position of the box in the file
+	Size   int64 // full size including header
+}
+
+// containers lists box types that only contain other boxes
+var containers = map[string]bool{
+	"moov": true,
+	"trak": true,
+	"mdia": true,
+	"minf": true,
+	"stbl": true,
+	"edts": true,
+	"dinf": true,
+	"mvex": true,
+	"moof": true,
+	"traf": true,
+}
+
+// ReadBoxes parses all boxes found in r between off and end
+func ReadBoxes(r io.ReaderAt, off, end int64) ([]*Box, error) {
+	var res []*Box
+	for off < end {
+		b, err := readBox(r, off, end)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, b)
+		off += b.Size
+	}
+	return res, nil
+}
+
+func readBox(r io.ReaderAt, off, end int64) (*Box, error) {
+	var hdr [16]byte
+	if _, err := r.ReadAt(hdr[:8], off); err != nil {
+		return nil, fmt.Errorf("%w: failed to read box header at %d: %s", ErrInvalid, off, err)
+	}
+	b := &Box{
+		Type:   string(hdr[4:8]),
+		Offset: off,
+		Size:   int64(binary.BigEndian.Uint32(hdr[:4])),
+	}
+	hdrLen := int64(8)
+	switch b.Size {
+	case 0:
+		// box extends to end of file
+		b.Size = end - off
+	case 1:
+		if _, err := r.ReadAt(hdr[8:16], off+8); err != nil {
+			return nil, fmt.Errorf("%w: failed to read box header at %d: %s", ErrInvalid, off, err)
+		}
+		b.Size = int64(binary.BigEndian.Uint64(hdr[8:16]))
+		hdrLen = 16
+	}
+	if b.Size < hdrLen || off+b.Size > end {
+		return nil, fmt.Errorf("%w: box %q at %d has invalid size %d", ErrInvalid, b.Type, off, b.Size)
+	}
+
+	switch {
+	case containers[b.Type]:
+		children, err := ReadBoxes(r, off+hdrLen, off+b.Size)
+		if err != nil {
+			return nil, err
+		}
+		b.Children = children
+	case b.Type == "mdat":
+		// not loaded
+	default:
+		b.Data = make([]byte, b.Size-hdrLen)
+		if _, err := r.ReadAt(b.Data, off+hdrLen); err != nil {
+			return nil, fmt.Errorf("%w: failed to read box %q at %d: %s", ErrInvalid, b.Type, off, err)
+		}
+	}
+	return b, nil
+}
+
+// Child returns the first child box with the given type, following the
+// path if multiple types are given
+func (b *Box) Child(typ ...string) *Box {
+	for _, t := range typ {
+		var found *Box
+		for _, c := range b.Children {
+			if c.Type == t {
+				found = c
+				break
+			}
+		}
+		if found == nil {
+			return nil
+		}
+		b = found
+	}
+	return b
+}
+
+// Bytes returns the encoded box
+func (b *Box) Bytes() []byte {
+	if b.Children == nil {
+		return makeBox(b.Type, b.Data)
+	}
+	var payload [][]byte
+	for _, c := range b.Children {
+		payload = append(payload, c.Bytes())
+	}
+	return makeBox(b.Type, payload...)
+}
+
+// makeBox returns a box with the given payload
+func makeBox(typ string, payload ...[]byte) []byte {
+	ln := 8
+	for _, p := range payload {
+		ln += len(p)
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, ln))
+	binary.Write(buf, binary.BigEndian, uint32(ln))
+	buf.WriteString(typ)
+	for _, p := range payload {
+		buf.Write(p)
+	}
+	return buf.Bytes()
+}
+
+// makeFullBox returns a box with version and flags
+func makeFullBox(typ string, version byte, flags uint32, payload ...[]byte) []byte {
+	vf := []byte{version, byte(flags >> 16), byte(flags >> 8), byte(flags)}
+	return makeBox(typ, append([][]byte{vf}, payload...)...)
+}
+
+// be returns the big endian encoding of the given values
+func be(v ...any) []byte {
+	buf := &bytes.Buffer{}
+	for _, x := range v {
+		binary.Write(buf, binary.BigEndian, x)
+	}
+	return buf.Bytes()
+}
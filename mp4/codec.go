@@ -0,0 +1,220 @@
+package mp4
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+const (
+	visualEntryLen = 78 // size of VisualSampleEntry fields
+	audioEntryLen  = 28 // size of AudioSampleEntry fields (version 0)
+)
+
+// Codec returns the RFC 6381 codecs string for the track, as used in the
+// CODECS attribute of HLS playlists, for example "avc1.640028". An error is
+// returned if the codec configuration is missing or invalid.
+func (t *Track) Codec() (string, error) {
+	e := t.sampleEntry()
+	if e == nil {
+		return "", fmt.Errorf("%w: track %d has no sample entry", ErrInvalid, t.ID)
+	}
+
+	switch e.Type {
+	case "avc1", "avc3":
+		c := entryChild(e, visualEntryLen, "avcC")
+		if len(c) < 4 {
+			return "", fmt.Errorf("%w: missing or truncated avcC", ErrInvalid)
+		}
+		return fmt.Sprintf("%s.%02x%02x%02x", e.Type, c[1], c[2], c[3]), nil
+	case "hvc1", "hev1":
+		c := entryChild(e, visualEntryLen, "hvcC")
+		if len(c) < 13 {
+			return "", fmt.Errorf("%w: missing or truncated hvcC", ErrInvalid)
+		}
+		return e.Type + "." + hevcCodec(c), nil
+	case "av01":
+		c := entryChild(e, visualEntryLen, "av1C")
+		if len(c) < 4 {
+			return "", fmt.Errorf("%w: missing or truncated av1C", ErrInvalid)
+		}
+		profile := c[1] >> 5
+		level := c[1] & 0x1f
+		tier := "M"
+		if c[2]&0x80 != 0 {
+			tier = "H"
+		}
+		depth := 8
+		if c[2]&0x40 != 0 {
+			depth = 10
+			if profile == 2 && c[2]&0x20 != 0 {
+				depth = 12
+			}
+		}
+		return fmt.Sprintf("av01.%d.%02d%s.%02d", profile, level, tier, depth), nil
+	case "mp4a":
+		c, err := aacCodec(entryChild(e, t.audioEntryLen(e), "esds"))
+		if err != nil {
+			return "", err
+		}
+		return "mp4a." + c, nil
+	case "Opus":
+		return "opus", nil
+	default:
+		return e.Type, nil
+	}
+}
+
+// hevcCodec returns the codec string parameters from a hvcC box
+func hevcCodec(c []byte) string {
+	res := &strings.Builder{}
+	space := c[1] >> 6
+	if space > 0 {
+		res.WriteByte('A' + space - 1)
+	}
+	fmt.Fprintf(res, "%d.", c[1]&0x1f)
+
+	// compatibility flags are written in reverse bit order
+	compat := binary.BigEndian.Uint32(c[2:6])
+	var rev uint32
+	for i := 0; i < 32; i++ {
+		rev = rev<<1 | (compat>>i)&1
+	}
+	fmt.Fprintf(res, "%X.", rev)
+
+	if c[1]&0x20 != 0 {
+		res.WriteByte('H')
+	} else {
+		res.WriteByte('L')
+	}
+	fmt.Fprintf(res, "%d", c[12])
+
+	// constraint flags, trailing zero bytes omitted
+	cons := c[6:12]
+	for len(cons) > 0 && cons[len(cons)-1] == 0 {
+		cons = cons[:len(cons)-1]
+	}
+	for _, b := range cons {
+		fmt.Fprintf(res, ".%X", b)
+	}
+	return res.String()
+}
+
+// errTruncatedESDS is returned by aacCodec for a malformed esds box
+var errTruncatedESDS = fmt.Errorf("%w: truncated esds", ErrInvalid)
+
+// aacCodec returns "40.<audio object type>" from an esds box payload
+func aacCodec(esds []byte) (string, error) {
+	// skip version & flags, then walk descriptors:
+	// ES_Descriptor(3) > DecoderConfigDescriptor(4) > DecoderSpecificInfo(5)
+	if len(esds) < 4 {
+		return "", errTruncatedESDS
+	}
+	buf := esds[4:]
+	oti := byte(0x40)
+	for len(buf) > 2 {
+		tag := buf[0]
+		buf = buf[1:]
+		// variable length size
+		ln := 0
+		for i := 0; i < 4 && len(buf) > 0; i++ {
+			b := buf[0]
+			buf = buf[1:]
+			ln = ln<<7 | int(b&0x7f)
+			if b&0x80 == 0 {
+				break
+			}
+		}
+		switch tag {
+		case 3:
+			// ES_ID, flags
+			if len(buf) < 3 {
+				return "", errTruncatedESDS
+			}
+			flags := buf[2]
+			buf = buf[3:]
+			if flags&0x80 != 0 && len(buf) >= 2 {
+				buf = buf[2:]
+			}
+			if flags&0x40 != 0 && len(buf) >= 1 {
+				// URL
+				if len(buf) <= int(buf[0]) {
+					return "", errTruncatedESDS
+				}
+				buf = buf[1+int(buf[0]):]
+			}
+			if flags&0x20 != 0 && len(buf) >= 2 {
+				buf = buf[2:]
+			}
+		case 4:
+			if len(buf) < 13 {
+				return "", errTruncatedESDS
+			}
+			oti = buf[0]
+			buf = buf[13:]
+		case 5:
+			if oti != 0x40 || len(buf) < 1 {
+				return fmt.Sprintf("%x", oti), nil
+			}
+			aot := buf[0] >> 3
+			if aot == 31 && len(buf) >= 2 {
+				aot = 32 + ((buf[0]&7)<<3 | buf[1]>>5)
+			}
+			return fmt.Sprintf("40.%d", aot), nil
+		default:
+			if ln > len(buf) {
+				return "", errTruncatedESDS
+			}
+			buf = buf[ln:]
+		}
+	}
+	return fmt.Sprintf("%x", oti), nil
+}
+
+// audioEntryLen returns the length of the audio sample entry fields, which
+// depends on the entry version
+func (t *Track) audioEntryLen(e *Box) int {
+	if len(e.Data) < audioEntryLen {
+		return audioEntryLen
+	}
+	switch binary.BigEndian.Uint16(e.Data[8:10]) {
+	case 1:
+		return audioEntryLen + 16
+	case 2:
+		return audioEntryLen + 36
+	default:
+		return audioEntryLen
+	}
+}
+
+// Size returns the width and height of a video track
+func (t *Track) Size() (int, int) {
+	e := t.sampleEntry()
+	if e == nil || len(e.Data) < visualEntryLen {
+		return 0, 0
+	}
+	return int(binary.BigEndian.Uint16(e.Data[24:26])), int(binary.BigEndian.Uint16(e.Data[26:28]))
+}
+
+// Channels returns the number of channels of an audio track
+func (t *Track) Channels() int {
+	e := t.sampleEntry()
+	if e == nil || len(e.Data) < audioEntryLen {
+		return 0
+	}
+	if e.Type == "Opus" {
+		// channel count in dOps is authoritative
+		if c := entryChild(e, t.audioEntryLen(e), "dOps"); len(c) >= 2 {
+			return int(c[1])
+		}
+	}
+	return int(binary.BigEndian.Uint16(e.Data[16:18]))
+}
+
+// FrameRate returns the average frame rate of a video track
+func (t *Track) FrameRate() float64 {
+	if t.Duration == 0 {
+		return 0
+	}
+	return float64(len(t.Samples)) / t.Seconds(t.Duration)
+}
@@ -0,0 +1,152 @@
+package mp4
+
+import (
+	"io"
+)
+
+// trun flags
+const (
+	trunDataOffset = 0x000001
+	trunDuration   = 0x000100
+	trunSize       = 0x000200
+	trunFlags      = 0x000400
+	trunCTO        = 0x000800
+)
+
+// sample flags for sync and non-sync samples
+const (
+	sampleSync    = 0x02000000 // sample_depends_on=2 (does not depend on others)
+	sampleNonSync = 0x01010000 // sample_depends_on=1, sample_is_non_sync_sample
+)
+
+// WriteInit writes a CMAF init segment for the track to w
+func (t *Track) WriteInit(w io.Writer) error {
+	ftyp := makeBox("ftyp", []byte("iso6"), be(uint32(0)), []byte("iso6cmfcmp41"))
+
+	mvhd := zeroDuration(t.f.moov.Child("mvhd"), 16, 24)
+	if mvhd == nil {
+		// build one from the track information
+		mvhd = makeFullBox("mvhd", 0, 0,
+			be(uint32(0), uint32(0), t.Timescale, uint32(0), uint32(0x00010000), uint16(0x0100)),
+			make([]byte, 10),
+			be(uint32(0x00010000), uint32(0), uint32(0), uint32(0), uint32(0x00010000), uint32(0), uint32(0), uint32(0), uint32(0x40000000)),
+			make([]byte, 24),
+			be(t.ID+1),
+		)
+	}
+
+	// build trak
+	var trak [][]byte
+	for _, b := range t.trak.Children {
+		switch b.Type {
+		case "tkhd":
+			trak = append(trak, zeroDuration(b, 20, 28))
+		case "edts":
+			// keep edit list, mostly used to compensate for b-frames or audio priming
+			trak = append(trak, b.Bytes())
+		case "mdia":
+			var mdia [][]byte
+			for _, b := range b.Children {
+				switch b.Type {
+				case "mdhd":
+					mdia = append(mdia, zeroDuration(b, 16, 24))
+				case "minf":
+					var minf [][]byte
+					for _, b := range b.Children {
+						if b.Type == "stbl" {
+							minf = append(minf, makeBox("stbl",
+								b.Child("stsd").Bytes(),
+								makeFullBox("stts", 0, 0, be(uint32(0))),
+								makeFullBox("stsc", 0, 0, be(uint32(0))),
+								makeFullBox("stsz", 0, 0, be(uint32(0), uint32(0))),
+								makeFullBox("stco", 0, 0, be(uint32(0))),
+							))
+							continue
+						}
+						minf = append(minf, b.Bytes())
+					}
+					mdia = append(mdia, makeBox("minf", minf...))
+				default:
+					mdia = append(mdia, b.Bytes())
+				}
+			}
+			trak = append(trak, makeBox("mdia", mdia...))
+		}
+	}
+
+	mvex := makeBox("mvex", makeFullBox("trex", 0, 0, be(t.ID, uint32(1), uint32(0), uint32(0), uint32(0))))
+	moov := makeBox("moov", mvhd, makeBox("trak", trak...), mvex)
+
+	_, err := w.Write(append(ftyp, moov...))
+	return err
+}
+
+// zeroDuration returns a copy of a mvhd, tkhd or mdhd box with its duration
+// set to zero, as required for fragmented files. Duration is found at off0 for
+// version 0 boxes and off1 for version 1 boxes.
+func zeroDuration(b *Box, off0, off1 int) []byte {
+	if b == nil || len(b.Data) < 4 {
+		return nil
+	}
+	data := append([]byte{}, b.Data...)
+	if data[0] == 1 {
+		if len(data) >= off1+8 {
+			copy(data[off1:off1+8], make([]byte, 8))
+		}
+	} else if len(data) >= off0+4 {
+		copy(data[off0:off0+4], make([]byte, 4))
+	}
+	return makeBox(b.Type, data)
+}
+
+// WriteFragment writes a moof+mdat fragment containing the given samples,
+// which must be consecutive samples of the track. It returns the size of the
+// fragment headers (moof and mdat header, after which sample data starts) and
+// the total number of bytes written.
+func (t *Track) WriteFragment(w io.Writer, seq uint32, samples []Sample) (int64, int64, error) {
+	var dataLen int64
+	trun := make([][]byte, 0, len(samples)+2)
+	trun = append(trun, be(uint32(len(samples)), uint32(0))) // data offset filled later
+	for _, s := range samples {
+		flags := uint32(sampleNonSync)
+		if s.Sync {
+			flags = sampleSync
+		}
+		trun = append(trun, be(s.Duration, s.Size, flags, s.CTO))
+		dataLen += int64(s.Size)
+	}
+	trunBox := makeFullBox("trun", 1, trunDataOffset|trunDuration|trunSize|trunFlags|trunCTO, trun...)
+
+	tfhd := makeFullBox("tfhd", 0, 0x020000, be(t.ID)) // default-base-is-moof
+	tfdt := makeFullBox("tfdt", 1, 0, be(samples[0].DTS))
+	moof := makeBox("moof",
+		makeFullBox("mfhd", 0, 0, be(seq)),
+		makeBox("traf", tfhd, tfdt, trunBox),
+	)
+
+	// data offset is relative to the start of moof, and points after mdat header
+	hdrLen := int64(len(moof)) + 8
+	dataOffsetPos := len(moof) - len(trunBox) + 16
+	copy(moof[dataOffsetPos:], be(uint32(hdrLen)))
+
+	mdatHdr := be(uint32(dataLen+8), [4]byte{'m', 'd', 'a', 't'})
+	if _, err := w.Write(append(moof, mdatHdr...)); err != nil {
+		return 0, 0, err
+	}
+
+	// copy sample data, merging contiguous samples in a single read
+	for n := 0; n < len(samples); {
+		off := samples[n].Offset
+		ln := int64(samples[n].Size)
+		n++
+		for n < len(samples) && samples[n].Offset == off+ln {
+			ln += int64(samples[n].Size)
+			n++
+		}
+		if _, err := io.Copy(w, io.NewSectionReader(t.f.r, off, ln)); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	return hdrLen, hdrLen + dataLen, nil
+}
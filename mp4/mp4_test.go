@@ -0,0 +1,205 @@
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+// makeTestFile builds a single video track mp4 with 6 samples of 1000 ticks
+// at timescale 12000, with a keyframe every 3 samples, stored in 2 chunks
+func makeTestFile() ([]byte, [][]byte) {
+	var samples [][]byte
+	for n := 0; n < 6; n++ {
+		samples = append(samples, bytes.Repeat([]byte{byte('a' + n)}, 10+n))
+	}
+
+	avcC := makeBox("avcC", []byte{1, 0x64, 0x00, 0x1f, 0xff, 0xe0, 0x00})
+	entry := make([]byte, visualEntryLen)
+	binary.BigEndian.PutUint16(entry[6:], 1)
+	binary.BigEndian.PutUint16(entry[24:], 1280)
+	binary.BigEndian.PutUint16(entry[26:], 720)
+	stsd := makeFullBox("stsd", 0, 0, be(uint32(1)), makeBox("avc1", entry, avcC))
+
+	ftyp := makeBox("ftyp", []byte("isom"), be(uint32(0)), []byte("isom"))
+	var data []byte
+	for _, s := range samples {
+		data = append(data, s...)
+	}
+	mdat := makeBox("mdat", data)
+	base := uint32(len(ftyp) + 8)
+	chunk2 := base + uint32(len(samples[0])+len(samples[1])+len(samples[2]))
+
+	var sizes [][]byte
+	for _, s := range samples {
+		sizes = append(sizes, be(uint32(len(s))))
+	}
+
+	stbl := makeBox("stbl",
+		stsd,
+		makeFullBox("stts", 0, 0, be(uint32(1), uint32(6), uint32(1000))),
+		makeFullBox("ctts", 0, 0, be(uint32(2), uint32(1), uint32(0), uint32(5), uint32(2000))),
+		makeFullBox("stss", 0, 0, be(uint32(2), uint32(1), uint32(4))),
+		makeFullBox("stsz", 0, 0, append(be(uint32(0), uint32(6)), bytes.Join(sizes, nil)...)),
+		makeFullBox("stsc", 0, 0, be(uint32(1), uint32(1), uint32(3), uint32(1))),
+		makeFullBox("stco", 0, 0, be(uint32(2), base, chunk2)),
+	)
+	trak := makeBox("trak",
+		makeFullBox("tkhd", 0, 3, be(uint32(0), uint32(0), uint32(1), uint32(0), uint32(6000)), make([]byte, 60)),
+		makeBox("mdia",
+			makeFullBox("mdhd", 0, 0, be(uint32(0), uint32(0), uint32(12000), uint32(6000), uint16(0x55c4), uint16(0))),
+			makeFullBox("hdlr", 0, 0, be(uint32(0)), []byte("vide"), make([]byte, 13)),
+			makeBox("minf", makeFullBox("vmhd", 0, 1, make([]byte, 8)), stbl),
+		),
+	)
+	moov := makeBox("moov",
+		makeFullBox("mvhd", 0, 0, be(uint32(0), uint32(0), uint32(1000), uint32(500)), make([]byte, 80)),
+		trak,
+	)
+
+	return append(append(ftyp, mdat...), moov...), samples
+}
+
+func TestTrack(t *testing.T) {
+	buf, samples := makeTestFile()
+	f, err := New(bytes.NewReader(buf), int64(len(buf)))
+	if err != nil {
+		t.Fatalf("failed to parse: %s", err)
+	}
+	if len(f.Tracks) != 1 {
+		t.Fatalf("expected 1 track, got %d", len(f.Tracks))
+	}
+	tr := f.Tracks[0]
+	if tr.Handler != "vide" || tr.Timescale != 12000 || tr.Duration != 6000 || len(tr.Samples) != 6 {
+		t.Errorf("unexpected track %+v", tr)
+	}
+	for n, s := range tr.Samples {
+		if !bytes.Equal(buf[s.Offset:s.Offset+int64(s.Size)], samples[n]) {
+			t.Errorf("sample %d: bad offset %d", n, s.Offset)
+		}
+		if s.DTS != uint64(n*1000) || s.Sync != (n%3 == 0) {
+			t.Errorf("sample %d: unexpected %+v", n, s)
+		}
+	}
+	if tr.Samples[1].CTO != 2000 {
+		t.Errorf("unexpected composition offset %d", tr.Samples[1].CTO)
+	}
+	if c, err := tr.Codec(); err != nil || c != "avc1.64001f" {
+		t.Errorf("unexpected codec %s (err=%v)", c, err)
+	}
+	if w, h := tr.Size(); w != 1280 || h != 720 {
+		t.Errorf("unexpected size %dx%d", w, h)
+	}
+}
+
+func TestTrackInvalid(t *testing.T) {
+	buf, _ := makeTestFile()
+
+	// no sample description
+	bad := bytes.Replace(buf, []byte("stsd"), []byte("free"), 1)
+	if _, err := New(bytes.NewReader(bad), int64(len(bad))); !errors.Is(err, ErrInvalid) {
+		t.Errorf("expected invalid file without stsd, got %v", err)
+	}
+
+	// fixed size samples that cannot fit in the file
+	bad = append([]byte{}, buf...)
+	pos := bytes.Index(bad, []byte("stsz")) + 8
+	binary.BigEndian.PutUint32(bad[pos:], 1)
+	binary.BigEndian.PutUint32(bad[pos+4:], 0xffffffff)
+	if _, err := New(bytes.NewReader(bad), int64(len(bad))); !errors.Is(err, ErrInvalid) {
+		t.Errorf("expected invalid file with huge stsz count, got %v", err)
+	}
+
+	// no codec configuration
+	bad = bytes.Replace(buf, []byte("avcC"), []byte("free"), 1)
+	f, err := New(bytes.NewReader(bad), int64(len(bad)))
+	if err != nil {
+		t.Fatalf("failed to parse: %s", err)
+	}
+	if c, err := f.Tracks[0].Codec(); !errors.Is(err, ErrInvalid) {
+		t.Errorf("expected codec error, got %q (err=%v)", c, err)
+	}
+}
+
+func TestFragment(t *testing.T) {
+	buf, samples := makeTestFile()
+	f, _ := New(bytes.NewReader(buf), int64(len(buf)))
+	tr := f.Tracks[0]
+
+	init := &bytes.Buffer{}
+	if err := tr.WriteInit(init); err != nil {
+		t.Fatalf("failed to write init: %s", err)
+	}
+	boxes, err := ReadBoxes(bytes.NewReader(init.Bytes()), 0, int64(init.Len()))
+	if err != nil || len(boxes) != 2 {
+		t.Fatalf("failed to parse init: %v", err)
+	}
+	moov := boxes[1]
+	if moov.Child("mvex", "trex") == nil || moov.Child("trak", "mdia", "minf", "stbl", "stsd") == nil {
+		t.Errorf("init is missing boxes")
+	}
+	if d := binary.BigEndian.Uint32(moov.Child("trak", "mdia", "mdhd").Data[16:]); d != 0 {
+		t.Errorf("mdhd duration was not reset: %d", d)
+	}
+
+	frag := &bytes.Buffer{}
+	hdrLen, total, err := tr.WriteFragment(frag, 2, tr.Samples[3:])
+	if err != nil {
+		t.Fatalf("failed to write fragment: %s", err)
+	}
+	if total != int64(frag.Len()) {
+		t.Errorf("fragment size %d, expected %d", frag.Len(), total)
+	}
+	if got, expect := frag.Bytes()[hdrLen:], bytes.Join(samples[3:], nil); !bytes.Equal(got, expect) {
+		t.Errorf("unexpected fragment data %q", got)
+	}
+
+	boxes, err = ReadBoxes(bytes.NewReader(frag.Bytes()), 0, int64(frag.Len()))
+	if err != nil || len(boxes) != 2 || boxes[0].Type != "moof" || boxes[1].Type != "mdat" {
+		t.Fatalf("failed to parse fragment: %v", err)
+	}
+	p := &fields{buf: boxes[0].Child("traf", "tfdt").Data}
+	p.skip(4)
+	if dts := p.u64(); dts != 3000 {
+		t.Errorf("unexpected base decode time %d", dts)
+	}
+	p = &fields{buf: boxes[0].Child("traf", "trun").Data}
+	p.skip(4)
+	if cnt, off := p.u32(), p.u32(); cnt != 3 || int64(off) != hdrLen {
+		t.Errorf("unexpected trun count=%d offset=%d", cnt, off)
+	}
+	if dur, size, flags := p.u32(), p.u32(), p.u32(); dur != 1000 || size != 13 || flags != sampleSync {
+		t.Errorf("unexpected first sample duration=%d size=%d flags=%x", dur, size, flags)
+	}
+}
+
+func TestCodecStrings(t *testing.T) {
+	hvcC := []byte{1, 0x01, 0x60, 0, 0, 0, 0x90, 0, 0, 0, 0, 0, 120}
+	if c := hevcCodec(hvcC); c != "1.6.L120.90" {
+		t.Errorf("unexpected hevc codec %s", c)
+	}
+
+	esds := func(asc ...byte) []byte {
+		dsi := append([]byte{5, byte(len(asc))}, asc...)
+		dcd := append([]byte{4, byte(13 + len(dsi)), 0x40, 0x15}, make([]byte, 11)...)
+		dcd = append(dcd, dsi...)
+		es := append([]byte{3, byte(3 + len(dcd)), 0, 2, 0}, dcd...)
+		return append([]byte{0, 0, 0, 0}, es...)
+	}
+	if c, err := aacCodec(esds(0x12, 0x10)); err != nil || c != "40.2" {
+		t.Errorf("unexpected aac-lc codec %s (%v)", c, err)
+	}
+	if c, err := aacCodec(esds(0x2b, 0x92, 0x08, 0x00)); err != nil || c != "40.5" {
+		t.Errorf("unexpected he-aac codec %s (%v)", c, err)
+	}
+
+	// URL flag with a length past the end of the box
+	truncated := []byte{0, 0, 0, 0, 3, 8, 0, 2, 0x40, 0x20, 'h', 't', 't', 'p'}
+	if _, err := aacCodec(truncated); err == nil {
+		t.Errorf("expected error for truncated esds")
+	}
+	for n := range truncated {
+		aacCodec(truncated[:n])
+	}
+}
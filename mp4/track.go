@@ -0,0 +1,391 @@
+package mp4
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// File is a regular (non fragmented) mp4 file
+type File struct {
+	Tracks []*Track
+
+	moov *Box
+	r    io.ReaderAt
+	c    io.Closer
+}
+
+// Track is a track of a File with its samples
+type Track struct {
+	ID        uint32
+	Handler   string // vide, soun, etc
+	Timescale uint32
+	Duration  uint64 // sum of samples durations, in Timescale units
+	Samples   []Sample
+
+	trak *Box
+	f    *File
+}
+
+// Sample is a single sample (frame) of a track
+type Sample struct {
+	Offset   int64  // position of the data in the file
+	Size     uint32 // size of the data
+	DTS      uint64 // decode time, in track timescale
+	Duration uint32
+	CTO      int32 // composition time offset
+	Sync     bool  // key frame
+}
+
+// Open opens and parses the given mp4 file
+func Open(fn string) (*File, error) {
+	fp, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	st, err := fp.Stat()
+	if err != nil {
+		fp.Close()
+		return nil, err
+	}
+	f, err := New(fp, st.Size())
+	if err != nil {
+		fp.Close()
+		return nil, err
+	}
+	f.c = fp
+	return f, nil
+}
+
+// New parses a mp4 file of the given size accessible through r
+func New(r io.ReaderAt, size int64) (*File, error) {
+	boxes, err := ReadBoxes(r, 0, size)
+	if err != nil {
+		return nil, err
+	}
+	f := &File{r: r}
+	for _, b := range boxes {
+		if b.Type == "moov" {
+			f.moov = b
+		}
+	}
+	if f.moov == nil {
+		return nil, fmt.Errorf("%w: moov box not found", ErrInvalid)
+	}
+	for _, b := range f.moov.Children {
+		if b.Type != "trak" {
+			continue
+		}
+		t, err := parseTrack(b, size)
+		if err != nil {
+			return nil, err
+		}
+		t.f = f
+		f.Tracks = append(f.Tracks, t)
+	}
+	return f, nil
+}
+
+// Close closes the underlying file if opened with Open
+func (f *File) Close() error {
+	if f.c == nil {
+		return nil
+	}
+	return f.c.Close()
+}
+
+// reader for fixed size big endian fields in box payloads
+type fields struct {
+	buf []byte
+	err error
+}
+
+func (p *fields) skip(n int) {
+	if p.err != nil {
+		return
+	}
+	if len(p.buf) < n {
+		p.err = fmt.Errorf("%w: box too short", ErrInvalid)
+		p.buf = nil
+		return
+	}
+	p.buf = p.buf[n:]
+}
+
+func (p *fields) u8() uint8 {
+	if p.err != nil || len(p.buf) < 1 {
+		p.skip(1)
+		return 0
+	}
+	v := p.buf[0]
+	p.buf = p.buf[1:]
+	return v
+}
+
+func (p *fields) u16() uint16 {
+	if p.err != nil || len(p.buf) < 2 {
+		p.skip(2)
+		return 0
+	}
+	v := binary.BigEndian.Uint16(p.buf)
+	p.buf = p.buf[2:]
+	return v
+}
+
+func (p *fields) u32() uint32 {
+	if p.err != nil || len(p.buf) < 4 {
+		p.skip(4)
+		return 0
+	}
+	v := binary.BigEndian.Uint32(p.buf)
+	p.buf = p.buf[4:]
+	return v
+}
+
+func (p *fields) u64() uint64 {
+	if p.err != nil || len(p.buf) < 8 {
+		p.skip(8)
+		return 0
+	}
+	v := binary.BigEndian.Uint64(p.buf)
+	p.buf = p.buf[8:]
+	return v
+}
+
+// box returns the fields of a child box, following the given path
+func boxFields(b *Box, path ...string) (*fields, error) {
+	c := b.Child(path...)
+	if c == nil {
+		return nil, fmt.Errorf("%w: missing box %v", ErrInvalid, path)
+	}
+	return &fields{buf: c.Data}, nil
+}
+
+func parseTrack(trak *Box, size int64) (*Track, error) {
+	t := &Track{trak: trak}
+
+	p, err := boxFields(trak, "tkhd")
+	if err != nil {
+		return nil, err
+	}
+	if p.u8() == 1 {
+		p.skip(3 + 16)
+	} else {
+		p.skip(3 + 8)
+	}
+	t.ID = p.u32()
+
+	p, err = boxFields(trak, "mdia", "mdhd")
+	if err != nil {
+		return nil, err
+	}
+	if p.u8() == 1 {
+		p.skip(3 + 16)
+	} else {
+		p.skip(3 + 8)
+	}
+	t.Timescale = p.u32()
+
+	p, err = boxFields(trak, "mdia", "hdlr")
+	if err != nil {
+		return nil, err
+	}
+	p.skip(8)
+	t.Handler = string(p.buf[:min(4, len(p.buf))])
+
+	if p.err != nil {
+		return nil, p.err
+	}
+	if t.Timescale == 0 {
+		return nil, fmt.Errorf("%w: track %d has no timescale", ErrInvalid, t.ID)
+	}
+
+	stbl := trak.Child("mdia", "minf", "stbl")
+	if stbl == nil {
+		return nil, fmt.Errorf("%w: track %d has no sample table", ErrInvalid, t.ID)
+	}
+	if stbl.Child("stsd") == nil {
+		return nil, fmt.Errorf("%w: track %d has no sample description", ErrInvalid, t.ID)
+	}
+	if err := t.parseSamples(stbl, size); err != nil {
+		return nil, fmt.Errorf("track %d: %w", t.ID, err)
+	}
+	return t, nil
+}
+
+// parseSamples reads the sample table of a track in a file of the given size
+func (t *Track) parseSamples(stbl *Box, size int64) error {
+	// sizes
+	p, err := boxFields(stbl, "stsz")
+	if err != nil {
+		return err
+	}
+	p.skip(4)
+	fixed := p.u32()
+	cnt := p.u32()
+	if p.err != nil || (fixed == 0 && uint64(len(p.buf)) < uint64(cnt)*4) {
+		return fmt.Errorf("%w: bad stsz", ErrInvalid)
+	}
+	if fixed != 0 && uint64(cnt)*uint64(fixed) > uint64(size) {
+		// samples would not fit in the file
+		return fmt.Errorf("%w: stsz declares %d samples of %d bytes", ErrInvalid, cnt, fixed)
+	}
+	t.Samples = make([]Sample, cnt)
+	for n := range t.Samples {
+		if fixed != 0 {
+			t.Samples[n].Size = fixed
+		} else {
+			t.Samples[n].Size = p.u32()
+		}
+	}
+
+	// durations
+	p, err = boxFields(stbl, "stts")
+	if err != nil {
+		return err
+	}
+	p.skip(4)
+	n := 0
+	var dts uint64
+	for i := p.u32(); i > 0 && p.err == nil; i-- {
+		count, delta := p.u32(), p.u32()
+		for ; count > 0 && n < len(t.Samples); count-- {
+			t.Samples[n].DTS = dts
+			t.Samples[n].Duration = delta
+			dts += uint64(delta)
+			n++
+		}
+	}
+	if p.err != nil || n != len(t.Samples) {
+		return fmt.Errorf("%w: bad stts", ErrInvalid)
+	}
+	t.Duration = dts
+
+	// composition offsets (optional)
+	if p, err = boxFields(stbl, "ctts"); err == nil {
+		p.skip(4)
+		n = 0
+		for i := p.u32(); i > 0 && p.err == nil; i-- {
+			count, off := p.u32(), int32(p.u32())
+			for ; count > 0 && n < len(t.Samples); count-- {
+				t.Samples[n].CTO = off
+				n++
+			}
+		}
+		if p.err != nil {
+			return fmt.Errorf("%w: bad ctts", ErrInvalid)
+		}
+	}
+
+	// sync samples (optional, all samples are sync if missing)
+	if p, err = boxFields(stbl, "stss"); err == nil {
+		p.skip(4)
+		for i := p.u32(); i > 0 && p.err == nil; i-- {
+			if s := p.u32(); s > 0 && int(s) <= len(t.Samples) {
+				t.Samples[s-1].Sync = true
+			}
+		}
+		if p.err != nil {
+			return fmt.Errorf("%w: bad stss", ErrInvalid)
+		}
+	} else {
+		for n := range t.Samples {
+			t.Samples[n].Sync = true
+		}
+	}
+
+	// chunk offsets
+	var chunks []int64
+	if p, err = boxFields(stbl, "stco"); err == nil {
+		p.skip(4)
+		for i := p.u32(); i > 0 && p.err == nil; i-- {
+			chunks = append(chunks, int64(p.u32()))
+		}
+	} else if p, err = boxFields(stbl, "co64"); err == nil {
+		p.skip(4)
+		for i := p.u32(); i > 0 && p.err == nil; i-- {
+			chunks = append(chunks, int64(p.u64()))
+		}
+	} else {
+		return err
+	}
+	if p.err != nil {
+		return fmt.Errorf("%w: bad chunk offsets", ErrInvalid)
+	}
+
+	// samples to chunks
+	p, err = boxFields(stbl, "stsc")
+	if err != nil {
+		return err
+	}
+	p.skip(4)
+	type stscEntry struct{ first, perChunk uint32 }
+	var runs []stscEntry
+	for i := p.u32(); i > 0 && p.err == nil; i-- {
+		runs = append(runs, stscEntry{p.u32(), p.u32()})
+		p.skip(4) // sample description index
+	}
+	if p.err != nil {
+		return fmt.Errorf("%w: bad stsc", ErrInvalid)
+	}
+
+	n = 0
+	for i, run := range runs {
+		last := uint32(len(chunks))
+		if i+1 < len(runs) {
+			last = runs[i+1].first - 1
+		}
+		for c := run.first; c <= last && c >= 1 && int(c) <= len(chunks); c++ {
+			off := chunks[c-1]
+			for s := uint32(0); s < run.perChunk && n < len(t.Samples); s++ {
+				t.Samples[n].Offset = off
+				off += int64(t.Samples[n].Size)
+				n++
+			}
+		}
+	}
+	if n != len(t.Samples) {
+		return fmt.Errorf("%w: chunks only cover %d samples out of %d", ErrInvalid, n, len(t.Samples))
+	}
+	return nil
+}
+
+// sampleEntry returns the first sample entry of the track's stsd
+func (t *Track) sampleEntry() *Box {
+	stsd := t.trak.Child("mdia", "minf", "stbl", "stsd")
+	if stsd == nil || len(stsd.Data) < 16 {
+		return nil
+	}
+	// skip version, flags & entry count
+	ln := int(binary.BigEndian.Uint32(stsd.Data[8:12]))
+	if ln < 8 || ln > len(stsd.Data)-8 {
+		return nil
+	}
+	return &Box{Type: string(stsd.Data[12:16]), Data: stsd.Data[16 : 8+ln]}
+}
+
+// entryChild returns the child box typ of the sample entry, which starts
+// after hdrLen bytes of sample entry fields
+func entryChild(e *Box, hdrLen int, typ string) []byte {
+	if len(e.Data) < hdrLen {
+		return nil
+	}
+	buf := e.Data[hdrLen:]
+	for len(buf) >= 8 {
+		ln := int(binary.BigEndian.Uint32(buf[:4]))
+		if ln < 8 || ln > len(buf) {
+			return nil
+		}
+		if string(buf[4:8]) == typ {
+			return buf[8:ln]
+		}
+		buf = buf[ln:]
+	}
+	return nil
+}
+
+// Seconds returns the given duration in the track's timescale in seconds
+func (t *Track) Seconds(d uint64) float64 {
+	return float64(d) / float64(t.Timescale)
+}
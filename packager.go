@@ -0,0 +1,217 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"path/filepath"
+	"slices"
+	"strconv"
+
+	"github.com/KarpelesLab/hlsmaker/mp4"
+)
+
+var (
+	packagerName    = flag.String("packager", "auto", "packager to use: shaka, ffmpeg, native or auto (shaka if available, native otherwise)")
+	segmentDuration = flag.Float64("segment_duration", 6, "target duration of segments in seconds (ffmpeg and native packagers)")
+)
+
+// Packager turns the encoded streams into fragmented mp4 segments and media
+// playlists, and generates {hls.dir}/master.m3u8 referencing them. Subtitle
+// streams are ignored as these are handled in build().
+type Packager interface {
+	Package(hls *hlsBuilder) error
+}
+
+// getPackager returns the packager selected on the command line
+func getPackager() (Packager, error) {
+	switch *packagerName {
+	case "auto":
+		if bin := shakaPath(); bin != "" {
+			return &shakaPackager{bin: bin}, nil
+		}
+		log.Printf("shaka-packager not available, using native packager")
+		return &nativePackager{}, nil
+	case "shaka":
+		bin := shakaPath()
+		if bin == "" {
+			return nil, fmt.Errorf("shaka-packager not found, use -shaka_bin to specify its location")
+		}
+		return &shakaPackager{bin: bin}, nil
+	case "ffmpeg":
+		return &ffmpegPackager{}, nil
+	case "native":
+		return &nativePackager{}, nil
+	default:
+		return nil, fmt.Errorf("unsupported packager %s", *packagerName)
+	}
+}
+
+// packagedStream holds the information on a packaged stream needed to
+// generate the master playlist
+type packagedStream struct {
+	ts        *hlsStream
+	codec     string
+	width     int
+	height    int
+	frameRate float64
+	channels  int
+
+	bandwidth    uint64 // peak
+	avgBandwidth uint64
+
+	iframePlaylist     string // empty if none
+	iframeBandwidth    uint64
+	iframeAvgBandwidth uint64
+}
+
+// probeStream returns codec information for an encoded stream
+func (hls *hlsBuilder) probeStream(ts *hlsStream) (*packagedStream, *mp4.File, error) {
+	f, err := mp4.Open(filepath.Join(hls.dir, ts.Filename()))
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(f.Tracks) != 1 {
+		f.Close()
+		return nil, nil, fmt.Errorf("expected a single track in %s, found %d", ts.Filename(), len(f.Tracks))
+	}
+	t := f.Tracks[0]
+	codec, err := t.Codec()
+	if err != nil {
+		f.Close()
+		return nil, nil, fmt.Errorf("in %s: %w", ts.Filename(), err)
+	}
+	ps := &packagedStream{ts: ts, codec: codec, frameRate: t.FrameRate(), channels: t.Channels()}
+	ps.width, ps.height = t.Size()
+	if ts.audio != nil {
+		// mp4 muxers store 2 channels in the sample entry of most codecs
+		ps.channels = ts.audio.channels()
+	}
+	return ps, f, nil
+}
+
+// writeMaster generates {hls.dir}/master.m3u8 for the given streams
+func (hls *hlsBuilder) writeMaster(streams []*packagedStream) error {
+	master := &MasterPlaylist{Version: 6, Independent: true}
+
+	var videos, audios []*packagedStream
+	for _, ps := range streams {
+		if ps.ts.typ == VideoStream {
+			videos = append(videos, ps)
+		} else {
+			audios = append(audios, ps)
+		}
+	}
+
+	// audio renditions, grouped by encoding settings
+	type audioGroup struct {
+		id         string
+		codecs     []string
+		bw, avgBw  uint64
+		hasDefault bool
+	}
+	var groups []*audioGroup
+	for _, a := range audios {
+		id := "audio"
+		if a.ts.audio != nil {
+			id = a.ts.audio.groupID()
+		}
+		idx := slices.IndexFunc(groups, func(g *audioGroup) bool { return g.id == id })
+		if idx == -1 {
+			idx = len(groups)
+			groups = append(groups, &audioGroup{id: id})
+		}
+		g := groups[idx]
+
+		name := a.ts.src.Tags["title"]
+		if name == "" {
+			name = fmt.Sprintf("stream_%d", a.ts.id)
+		}
+		r := master.AddRendition("AUDIO", id, name, a.ts.playlistName())
+		r.Language = a.ts.Language()
+		r.Default = !g.hasDefault
+		g.hasDefault = true
+		if a.channels > 0 {
+			r.Channels = strconv.Itoa(a.channels)
+		}
+
+		if !slices.Contains(g.codecs, a.codec) {
+			g.codecs = append(g.codecs, a.codec)
+		}
+		g.bw = max(g.bw, a.bandwidth)
+		g.avgBw = max(g.avgBw, a.avgBandwidth)
+	}
+	if len(groups) == 0 {
+		// video only
+		groups = append(groups, &audioGroup{})
+	}
+
+	// each video variant is listed once per audio group
+	for _, g := range groups {
+		for _, v := range videos {
+			vs := master.AddVariant(v.ts.playlistName(), v.bandwidth+g.bw)
+			vs.AverageBandwidth = v.avgBandwidth + g.avgBw
+			vs.Codecs = append([]string{v.codec}, g.codecs...)
+			vs.Width, vs.Height = v.width, v.height
+			vs.FrameRate = v.frameRate
+			vs.Audio = g.id
+			vs.ClosedCaptions = "NONE"
+		}
+	}
+
+	for _, v := range videos {
+		if v.iframePlaylist == "" {
+			continue
+		}
+		s := master.AddIFrameStream(v.iframePlaylist, v.iframeBandwidth)
+		s.AverageBandwidth = v.iframeAvgBandwidth
+		s.Codecs = []string{v.codec}
+		s.Width, s.Height = v.width, v.height
+	}
+
+	return master.SaveAs(filepath.Join(hls.dir, "master.m3u8"))
+}
+
+// updateBandwidth sets the BANDWIDTH and AVERAGE-BANDWIDTH of the variant and
+// I-frame streams of master to the bitrates measured on their segments, as
+// nominal bitrates do not apply to vbr and crf rate control and packagers
+// may estimate them differently. The highest audio bitrate of the variant's
+// audio group is included. playlists[n] is the playlist for
+// master.Playlists()[n] and must reference files in hls.dir.
+func (hls *hlsBuilder) updateBandwidth(master *MasterPlaylist, playlists []*MediaPlaylist) error {
+	byURI := make(map[string]*MediaPlaylist)
+	for n, uri := range master.Playlists() {
+		byURI[uri] = playlists[n]
+	}
+
+	type measured struct{ peak, avg uint64 }
+	audio := make(map[string]measured) // group id → highest bitrates
+	for _, r := range master.Renditions {
+		if r.Type != "AUDIO" || r.URI == "" {
+			continue
+		}
+		peak, avg, err := hls.segmentsBandwidth(byURI[r.URI])
+		if err != nil {
+			return err
+		}
+		m := audio[r.GroupID]
+		audio[r.GroupID] = measured{max(m.peak, peak), max(m.avg, avg)}
+	}
+
+	for _, v := range master.Variants {
+		peak, avg, err := hls.segmentsBandwidth(byURI[v.URI])
+		if err != nil {
+			return err
+		}
+		a := audio[v.Audio]
+		v.Bandwidth, v.AverageBandwidth = peak+a.peak, avg+a.avg
+	}
+	for _, s := range master.IFrames {
+		peak, avg, err := hls.segmentsBandwidth(byURI[s.URI])
+		if err != nil {
+			return err
+		}
+		s.Bandwidth, s.AverageBandwidth = peak, avg
+	}
+	return nil
+}
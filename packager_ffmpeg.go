@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+)
+
+// ffmpegPackager uses ffmpeg's hls muxer to segment streams. It does not
+// generate I-frame playlists.
+type ffmpegPackager struct{}
+
+func (p *ffmpegPackager) Package(hls *hlsBuilder) error {
+	var streams []*packagedStream
+
+	for _, ts := range hls.streams {
+		if ts.typ == SubsStream {
+			continue
+		}
+		ps, err := p.packageStream(hls, ts)
+		if err != nil {
+			return fmt.Errorf("while packaging %s: %w", ts, err)
+		}
+		streams = append(streams, ps)
+	}
+
+	return hls.writeMaster(streams)
+}
+
+func (p *ffmpegPackager) packageStream(hls *hlsBuilder, ts *hlsStream) (*packagedStream, error) {
+	ps, f, err := hls.probeStream(ts)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+
+	args := []string{"-hide_banner", "-y"}
+	if !*verboseMode {
+		args = append(args, "-loglevel", "warning")
+	}
+	args = append(args,
+		"-i", ts.Filename(),
+		"-map", "0",
+		"-c", "copy",
+		"-f", "hls",
+		"-hls_time", strconv.FormatFloat(*segmentDuration, 'f', -1, 64),
+		"-hls_playlist_type", "vod",
+		"-hls_segment_type", "fmp4",
+		"-hls_flags", "independent_segments",
+		"-hls_fmp4_init_filename", fmt.Sprintf("stream_%d_init.mp4", ts.id),
+		"-hls_segment_filename", fmt.Sprintf("stream_%d_%%d.m4s", ts.id),
+		"-start_number", "1",
+		ts.playlistName(),
+	)
+	if *verboseMode {
+		log.Printf("ffmpeg arguments: %v", args)
+	}
+
+	c := exec.Command(exe("ffmpeg"), args...)
+	c.Dir = hls.dir // set to run in temp dir
+	c.Stdout = os.Stdout
+	c.Stderr = os.Stderr
+	if err := c.Run(); err != nil {
+		return nil, fmt.Errorf("failed to run ffmpeg: %w", err)
+	}
+
+	ps.bandwidth, ps.avgBandwidth, err = hls.playlistBandwidth(ts.playlistName())
+	if err != nil {
+		return nil, err
+	}
+
+	return ps, nil
+}
+
+// playlistBandwidth returns the peak and average bandwidth of the segments
+// in the media playlist pfn
+func (hls *hlsBuilder) playlistBandwidth(pfn string) (peak, avg uint64, err error) {
+	pl, err := parseMedia(filepath.Join(hls.dir, pfn))
+	if err != nil {
+		return 0, 0, err
+	}
+	return hls.segmentsBandwidth(pl)
+}
+
+// segmentsBandwidth returns the peak and average bandwidth of the segments
+// in pl, which must reference files in hls.dir
+func (hls *hlsBuilder) segmentsBandwidth(pl *MediaPlaylist) (peak, avg uint64, err error) {
+	return measureBandwidth(pl, hls.fileSize)
+}
+
+// fileSize returns the size of the work file name
+func (hls *hlsBuilder) fileSize(name string) (int64, error) {
+	st, err := os.Stat(filepath.Join(hls.dir, name))
+	if err != nil {
+		return 0, err
+	}
+	return st.Size(), nil
+}
+
+// measureBandwidth returns the peak and average bandwidth of the segments in
+// pl, size returning the size of files referenced without a byte range
+func measureBandwidth(pl *MediaPlaylist, size func(name string) (int64, error)) (peak, avg uint64, err error) {
+	var total int64
+	for _, s := range pl.Segments {
+		var ln int64
+		if s.ByteRange != nil {
+			ln = s.ByteRange.Length
+		} else if ln, err = size(s.URI); err != nil {
+			return 0, 0, err
+		}
+		peak = max(peak, bitrate(ln, s.Duration))
+		total += ln
+	}
+	return peak, bitrate(total, pl.Duration()), nil
+}
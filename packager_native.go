@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+)
+
+// nativeSegment is a segment or, for I-frame playlists, a key frame
+type nativeSegment struct {
+	filename string
+	duration float64
+	offset   int64 // for byte ranges
+	length   int64
+}
+
+// nativePackager packages the streams into fragmented mp4 without external
+// tools, generating the same files as shaka-packager would
+type nativePackager struct{}
+
+func (p *nativePackager) Package(hls *hlsBuilder) error {
+	var streams []*packagedStream
+
+	for _, ts := range hls.streams {
+		if ts.typ == SubsStream {
+			// subtitles are handled in build()
+			continue
+		}
+		ps, err := hls.packageNative(ts)
+		if err != nil {
+			return fmt.Errorf("while packaging %s: %w", ts, err)
+		}
+		streams = append(streams, ps)
+	}
+
+	return hls.writeMaster(streams)
+}
+
+// packageNative writes init, segments and playlists for the given stream
+func (hls *hlsBuilder) packageNative(ts *hlsStream) (*packagedStream, error) {
+	ns, f, err := hls.probeStream(ts)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	t := f.Tracks[0]
+	if len(t.Samples) == 0 {
+		return nil, fmt.Errorf("no samples found in %s", ts.Filename())
+	}
+
+	initName := fmt.Sprintf("stream_%d_init.mp4", ts.id)
+	if err := writeFile(filepath.Join(hls.dir, initName), t.WriteInit); err != nil {
+		return nil, err
+	}
+
+	// cut samples into segments at key frames, and segments into fragments
+	// at each key frame, so I-frames can be addressed with byte ranges
+	target := uint64(*segmentDuration * float64(t.Timescale))
+	var segments, iframes []*nativeSegment
+	var seq uint32
+	var total, iframeTotal int64
+
+	for start := 0; start < len(t.Samples); {
+		end := start + 1
+		for end < len(t.Samples) && !(t.Samples[end].Sync && t.Samples[end].DTS-t.Samples[start].DTS >= target) {
+			end++
+		}
+		samples := t.Samples[start:end]
+		seg := &nativeSegment{
+			filename: fmt.Sprintf("stream_%d_%d.m4s", ts.id, len(segments)+1),
+			duration: t.Seconds(samples[len(samples)-1].DTS + uint64(samples[len(samples)-1].Duration) - samples[0].DTS),
+		}
+
+		err := writeFile(filepath.Join(hls.dir, seg.filename), func(w io.Writer) error {
+			for fs := 0; fs < len(samples); {
+				fe := fs + 1
+				for fe < len(samples) && !(ts.typ == VideoStream && samples[fe].Sync) {
+					fe++
+				}
+				if ts.typ != VideoStream {
+					// audio: a single fragment per segment
+					fe = len(samples)
+				}
+				seq += 1
+				hdrLen, n, err := t.WriteFragment(w, seq, samples[fs:fe])
+				if err != nil {
+					return err
+				}
+				if samples[fs].Sync {
+					last := samples[fe-1]
+					iframes = append(iframes, &nativeSegment{
+						filename: seg.filename,
+						duration: t.Seconds(last.DTS + uint64(last.Duration) - samples[fs].DTS),
+						offset:   seg.length,
+						length:   hdrLen + int64(samples[fs].Size),
+					})
+					iframeTotal += hdrLen + int64(samples[fs].Size)
+				}
+				seg.length += n
+				fs = fe
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		total += seg.length
+		ns.bandwidth = max(ns.bandwidth, bitrate(seg.length, seg.duration))
+		segments = append(segments, seg)
+		start = end
+	}
+	duration := t.Seconds(t.Duration)
+	ns.avgBandwidth = bitrate(total, duration)
+	log.Printf("native: %s packaged in %d segments (%s, avg %d bps)", ts, len(segments), ns.codec, ns.avgBandwidth)
+
+	pl := nativePlaylist(initName, segments, false)
+	if err := pl.SaveAs(filepath.Join(hls.dir, ts.playlistName())); err != nil {
+		return nil, err
+	}
+
+	if ts.typ == VideoStream {
+		for _, i := range iframes {
+			ns.iframeBandwidth = max(ns.iframeBandwidth, bitrate(i.length, i.duration))
+		}
+		ns.iframeAvgBandwidth = bitrate(iframeTotal, duration)
+		ns.iframePlaylist = fmt.Sprintf("stream_%d_iframe.m3u8", ts.id)
+		pl := nativePlaylist(initName, iframes, true)
+		if err := pl.SaveAs(filepath.Join(hls.dir, ns.iframePlaylist)); err != nil {
+			return nil, err
+		}
+	}
+
+	return ns, nil
+}
+
+// nativePlaylist returns a VOD media playlist for the given segments
+func nativePlaylist(initName string, segments []*nativeSegment, iframes bool) *MediaPlaylist {
+	res := newVODPlaylist(6)
+	res.IFramesOnly = iframes
+
+	for n, s := range segments {
+		seg := res.AddSegment(s.filename, s.duration)
+		if n == 0 {
+			seg.Map = &MediaMap{URI: initName}
+		}
+		if iframes {
+			seg.ByteRange = &ByteRange{Length: s.length, Offset: s.offset}
+		}
+	}
+	return res
+}
+
+// bitrate returns the bitrate in bits per second for ln bytes over duration
+func bitrate(ln int64, duration float64) uint64 {
+	if duration <= 0 {
+		return 0
+	}
+	return uint64(math.Ceil(float64(ln) * 8 / duration))
+}
+
+// writeFile creates fn and calls cb to write its contents
+func writeFile(fn string, cb func(w io.Writer) error) error {
+	f, err := os.Create(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := cb(f); err != nil {
+		return err
+	}
+	return f.Close()
+}
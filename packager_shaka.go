@@ -0,0 +1,74 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+)
+
+var (
+	shakaBin = flag.String("shaka_bin", "", "path to shaka-packager executable")
+)
+
+type shakaPackager struct {
+	bin string
+}
+
+// shakaPath returns the path to shaka-packager, or an empty string if it
+// could not be found
+func shakaPath() string {
+	if p := *shakaBin; p != "" {
+		return p
+	}
+
+	p := "/pkg/main/media-video.shaka-packager.core/bin/shaka-packager"
+	if _, err := os.Stat(p); err == nil {
+		return p
+	}
+
+	// official releases are named "packager"
+	for _, n := range []string{"shaka-packager", "packager"} {
+		if p, err := exec.LookPath(n); err == nil {
+			return p
+		}
+	}
+	return ""
+}
+
+func (p *shakaPackager) Package(hls *hlsBuilder) error {
+	// invoke shaka-packager
+	// https://shaka-project.github.io/shaka-packager/html/tutorials/hls.html#examples
+	cmd := []string{p.bin}
+
+	// for each in
+	for _, ts := range hls.streams {
+		if ts.typ == SubsStream {
+			// shaka has trouble reading some of ffmpeg subtitles files, and really we don't care about splitting these most of the time
+			continue
+		}
+		arg := "in=" + ts.Filename() + ",stream=" + ts.Typename()
+
+		arg += fmt.Sprintf(",init_segment=stream_%d_init.mp4,segment_template=stream_%d_$Number$.m4s", ts.id, ts.id)
+		if ts.typ == VideoStream {
+			arg += fmt.Sprintf(",iframe_playlist_name=stream_%d_iframe.m3u8", ts.id)
+		}
+		if ts.audio != nil {
+			arg += ",hls_group_id=" + ts.audio.groupID()
+		}
+
+		cmd = append(cmd, arg)
+	}
+
+	cmd = append(cmd, "--hls_playlist_type", "VOD", "--hls_master_playlist_output", "master.m3u8")
+
+	log.Printf("About to run: %v", cmd)
+
+	c := exec.Command(cmd[0], cmd[1:]...)
+	c.Dir = hls.dir // set to run in temp dir
+	c.Stdout = os.Stdout
+	c.Stderr = os.Stderr
+
+	return c.Run()
+}
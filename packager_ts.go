@@ -0,0 +1,150 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var (
+	segmentFormat = flag.String("segment_format", "fmp4", "segment format: fmp4, ts (MPEG-TS for legacy players, H.264/AAC only) or both")
+)
+
+// packageStreams runs the packager and/or the MPEG-TS segmenter depending on
+// -segment_format, generating {hls.dir}/master.m3u8
+func (hls *hlsBuilder) packageStreams() error {
+	switch *segmentFormat {
+	case "fmp4":
+		return hls.packager.Package(hls)
+	case "ts":
+		return hls.packageTS(false)
+	case "both":
+		if err := hls.packager.Package(hls); err != nil {
+			return err
+		}
+		return hls.packageTS(true)
+	default:
+		return fmt.Errorf("unsupported segment format %s", *segmentFormat)
+	}
+}
+
+// packageTS generates MPEG-TS variants for each H.264 video stream, muxed
+// with the first AAC-LC stereo audio stream as legacy players often do not
+// support alternate audio renditions, HE-AAC or surround audio. If appendMaster is true, the variants are added
+// to the existing master playlist.
+func (hls *hlsBuilder) packageTS(appendMaster bool) error {
+	master := &MasterPlaylist{Version: 3, Independent: true}
+	if appendMaster {
+		var err error
+		master, err = parseMaster(filepath.Join(hls.dir, "master.m3u8"))
+		if err != nil {
+			return err
+		}
+	}
+
+	var audio *packagedStream
+	for _, ts := range hls.streams {
+		if ts.typ != AudioStream {
+			continue
+		}
+		ps, f, err := hls.probeStream(ts)
+		if err != nil {
+			return err
+		}
+		f.Close()
+		if ps.codec == "mp4a.40.2" && ps.channels == 2 {
+			audio = ps
+			break
+		}
+	}
+	if audio == nil && len(hls.audios) > 0 {
+		log.Printf("ts: no AAC-LC stereo audio rendition, MPEG-TS variants will have no audio")
+	}
+
+	cnt := 0
+	for _, ts := range hls.streams {
+		if ts.typ != VideoStream {
+			continue
+		}
+		v, f, err := hls.probeStream(ts)
+		if err != nil {
+			return err
+		}
+		f.Close()
+		if !strings.HasPrefix(v.codec, "avc") {
+			log.Printf("ts: skipping %s, codec %s is not H.264", ts, v.codec)
+			continue
+		}
+
+		pfn, err := hls.segmentTS(v, audio)
+		if err != nil {
+			return fmt.Errorf("while packaging %s as MPEG-TS: %w", ts, err)
+		}
+
+		vs := master.AddVariant(pfn, v.bandwidth)
+		vs.AverageBandwidth = v.avgBandwidth
+		vs.Codecs = []string{v.codec}
+		if audio != nil {
+			vs.Codecs = append(vs.Codecs, audio.codec)
+		}
+		vs.Width, vs.Height = v.width, v.height
+		vs.FrameRate = v.frameRate
+		vs.ClosedCaptions = "NONE"
+		cnt += 1
+	}
+
+	if cnt == 0 {
+		return fmt.Errorf("no H.264 video stream available for MPEG-TS output")
+	}
+
+	return master.SaveAs(filepath.Join(hls.dir, "master.m3u8"))
+}
+
+// segmentTS muxes v and audio (if not nil) into MPEG-TS segments, sets the
+// bandwidth of v and returns the name of the generated playlist
+func (hls *hlsBuilder) segmentTS(v, audio *packagedStream) (string, error) {
+	pfn := fmt.Sprintf("stream_%d_ts.m3u8", v.ts.id)
+
+	args := []string{"-hide_banner", "-y"}
+	if !*verboseMode {
+		args = append(args, "-loglevel", "warning")
+	}
+	args = append(args, "-i", v.ts.Filename())
+	if audio != nil {
+		args = append(args, "-i", audio.ts.Filename(), "-map", "0:v", "-map", "1:a")
+	} else {
+		args = append(args, "-map", "0:v")
+	}
+	args = append(args,
+		"-c", "copy",
+		"-bsf:v", "h264_mp4toannexb",
+		"-f", "hls",
+		"-hls_time", strconv.FormatFloat(*segmentDuration, 'f', -1, 64),
+		"-hls_playlist_type", "vod",
+		"-hls_segment_type", "mpegts",
+		"-hls_flags", "independent_segments",
+		"-hls_segment_filename", fmt.Sprintf("stream_%d_%%d.ts", v.ts.id),
+		"-start_number", "1",
+		pfn,
+	)
+	if *verboseMode {
+		log.Printf("ffmpeg arguments: %v", args)
+	}
+
+	c := exec.Command(exe("ffmpeg"), args...)
+	c.Dir = hls.dir // set to run in temp dir
+	c.Stdout = os.Stdout
+	c.Stderr = os.Stderr
+	if err := c.Run(); err != nil {
+		return "", fmt.Errorf("failed to run ffmpeg: %w", err)
+	}
+
+	var err error
+	v.bandwidth, v.avgBandwidth, err = hls.playlistBandwidth(pfn)
+	return pfn, err
+}
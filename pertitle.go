@@ -0,0 +1,195 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+
+	"github.com/KarpelesLab/hlsmaker/hlsfile"
+)
+
+var (
+	perTitle = flag.Bool("per_title", false, "adjust ladder bitrates to the complexity of the source, measured with fast probe encodes")
+)
+
+const (
+	// complexitySamples is the number of sampled segments and their duration
+	complexitySamples  = 5
+	complexityDuration = 4.0
+
+	// complexityReference is the bits per pixel of typical content when
+	// encoded with the probe settings, which maps to a factor of 1
+	complexityReference = 0.05
+
+	// bounds of the bitrate factor
+	complexityMinFactor = 0.5
+	complexityMaxFactor = 2.0
+
+	// content with a factor up to complexityMergeFactor is low complexity:
+	// the largest size of the ladder is merged into the next one, if that
+	// one is at least complexityMergeSize
+	complexityMergeFactor = 0.75
+	complexityMergeSize   = 1080
+)
+
+// probeComplexity measures the complexity of the source by encoding sampled
+// segments at constant quality, and returns the result with the bitrate
+// factor to apply to the ladder with applyComplexity.
+func (hls *hlsBuilder) probeComplexity() (*hlsfile.ComplexityInfo, error) {
+	duration := hls.info.Format.Duration
+	rate := hls.frameRate()
+
+	src := &vsize{w: hls.video.Width, h: hls.video.Height}
+	siz := src
+	if src.short() > 720 {
+		siz = src.resize(720)
+	}
+	res := &hlsfile.ComplexityInfo{Width: siz.w, Height: siz.h, Factor: 1}
+	if duration <= 0 || math.IsNaN(duration) {
+		log.Printf("per-title: unknown source duration, keeping ladder bitrates")
+		return res, nil
+	}
+	vf := siz.Scale()
+	if *videoFilters != "" {
+		vf = *videoFilters + "," + vf
+	}
+
+	// evenly spaced samples, or the whole file if too short
+	var starts []float64
+	sampleLen := complexityDuration
+	if duration <= complexitySamples*complexityDuration {
+		starts = []float64{0}
+		sampleLen = duration
+	} else {
+		for n := 0; n < complexitySamples; n++ {
+			starts = append(starts, duration*(float64(n)+0.5)/complexitySamples-complexityDuration/2)
+		}
+	}
+
+	var total float64
+	for n, start := range starts {
+		fn := fmt.Sprintf("complexity_%d.h264", n)
+		args := []string{"-hide_banner", "-y", "-loglevel", "error",
+			"-ss", strconv.FormatFloat(start, 'f', 3, 64),
+			"-t", strconv.FormatFloat(sampleLen, 'f', 3, 64),
+			"-i", hls.input,
+			"-map", "0:v:0", "-an", "-sn",
+			"-vf", vf,
+			"-c:v", "libx264", "-preset", "veryfast", "-crf", "23",
+			"-f", "h264", fn,
+		}
+		if *verboseMode {
+			log.Printf("ffmpeg arguments: %v", args)
+		}
+		c := exec.Command(exe("ffmpeg"), args...)
+		c.Dir = hls.dir // set to run in temp dir
+		c.Stdout = os.Stdout
+		c.Stderr = os.Stderr
+		if err := c.Run(); err != nil {
+			return nil, fmt.Errorf("complexity probe failed: %w", err)
+		}
+
+		st, err := os.Stat(filepath.Join(hls.dir, fn))
+		if err != nil {
+			return nil, err
+		}
+		os.Remove(filepath.Join(hls.dir, fn))
+		if st.Size() == 0 {
+			// nothing decoded, such as past the end of the file
+			continue
+		}
+
+		bpp := float64(st.Size()) * 8 / (float64(siz.w) * float64(siz.h) * rate * sampleLen)
+		res.Samples = append(res.Samples, &hlsfile.ComplexitySample{Start: start, BitsPerPixel: bpp})
+		total += bpp
+	}
+
+	if len(res.Samples) == 0 {
+		log.Printf("per-title: complexity probe produced no data, keeping ladder bitrates")
+		return res, nil
+	}
+	res.BitsPerPixel = total / float64(len(res.Samples))
+	res.Factor = math.Round(max(complexityMinFactor, min(complexityMaxFactor, res.BitsPerPixel/complexityReference))*100) / 100
+	return res, nil
+}
+
+// applyComplexity adapts the ladder to the complexity of nfo: bitrates not
+// set explicitly are scaled by its factor without exceeding the source
+// bitrate (crf rungs already follow the complexity, only their default cap
+// is scaled), then the sizes not worth encoding are merged with mergeSizes.
+func (hls *hlsBuilder) applyComplexity(nfo *hlsfile.ComplexityInfo) {
+	rate := hls.frameRate()
+	src := uint64(hls.info.Format.BitRate)
+	capped := make(map[*hlsVariant]bool)
+	for _, v := range hls.variants {
+		r := *v.settings()
+		switch {
+		case r.rateControl() == "crf":
+			if r.MaxRate == 0 {
+				r.MaxRate = uint64(float64(v.maxRate(rate)) * nfo.Factor)
+			}
+		case r.Bitrate == 0:
+			r.Bitrate = uint64(float64(v.bitrate(rate)) * nfo.Factor)
+			if src > 0 && r.Bitrate >= src {
+				r.Bitrate = src
+				capped[v] = true
+			}
+			if r.MaxRate > 0 && r.Bitrate > r.MaxRate {
+				r.Bitrate = r.MaxRate
+			}
+		}
+		v.rung = &r
+	}
+	hls.mergeSizes(nfo, capped)
+}
+
+// mergeSizes drops the variants not worth encoding at the complexity of nfo,
+// leaving their clients to the next smaller size:
+//   - on low-complexity content, the largest size when the next one is at
+//     least complexityMergeSize, as it adds little visible detail
+//   - variants capped at the source bitrate when the same codec at the next
+//     smaller size is capped too, as they would not get more bits
+//
+// Dropped variants are recorded in nfo.
+func (hls *hlsBuilder) mergeSizes(nfo *hlsfile.ComplexityInfo, capped map[*hlsVariant]bool) {
+	var sizes []*vsize // from the largest
+	for _, v := range hls.variants {
+		if !slices.ContainsFunc(sizes, func(s *vsize) bool { return *s == *v.size }) {
+			sizes = append(sizes, v.size)
+		}
+	}
+	if len(sizes) < 2 {
+		return
+	}
+	slices.SortStableFunc(sizes, func(a, b *vsize) int { return b.short() - a.short() })
+	next := func(s *vsize) *vsize {
+		if n := slices.IndexFunc(sizes, func(o *vsize) bool { return *o == *s }); n+1 < len(sizes) {
+			return sizes[n+1]
+		}
+		return nil
+	}
+	mergeTop := nfo.Factor <= complexityMergeFactor && sizes[1].short() >= complexityMergeSize
+
+	var res []*hlsVariant
+	for _, v := range hls.variants {
+		drop := mergeTop && *v.size == *sizes[0]
+		if n := next(v.size); !drop && capped[v] && n != nil {
+			drop = slices.ContainsFunc(hls.variants, func(o *hlsVariant) bool {
+				return capped[o] && o.codec == v.codec && *o.size == *n
+			})
+		}
+		if drop {
+			log.Printf("per-title: dropping variant %s, merged into %s", v, next(v.size))
+			nfo.Dropped = append(nfo.Dropped, v.String())
+			continue
+		}
+		res = append(res, v)
+	}
+	hls.variants = res
+}
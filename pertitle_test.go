@@ -0,0 +1,85 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/KarpelesLab/ffprobe"
+	"github.com/KarpelesLab/hlsmaker/hlsfile"
+)
+
+func TestComplexityUnknownDuration(t *testing.T) {
+	hls := &hlsBuilder{
+		info:  &ffprobe.File{Format: &ffprobe.Format{}},
+		video: &ffprobe.Stream{Width: 1920, Height: 1080},
+	}
+	nfo, err := hls.probeComplexity()
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if nfo.Factor != 1 || len(nfo.Samples) != 0 {
+		t.Errorf("unexpected complexity %+v", nfo)
+	}
+}
+
+func TestApplyComplexity(t *testing.T) {
+	newBuilder := func(bitrate int) *hlsBuilder {
+		hls := &hlsBuilder{
+			info:  &ffprobe.File{Format: &ffprobe.Format{BitRate: bitrate}},
+			video: &ffprobe.Stream{Width: 3840, Height: 2160, FrameRate: "30/1"},
+		}
+		hls.variants = defaultLadder().variants(&vsize{3840, 2160})
+		return hls
+	}
+
+	// bitrates scaled by the factor, no size dropped
+	hls := newBuilder(0)
+	nfo := &hlsfile.ComplexityInfo{Factor: 1.5}
+	hls.applyComplexity(nfo)
+	if len(hls.variants) != 11 || len(nfo.Dropped) != 0 {
+		t.Fatalf("unexpected variants %v (dropped %v)", hls.variants, nfo.Dropped)
+	}
+	for _, v := range hls.variants {
+		if expect := uint64(float64(v.size.bitrate(30, v.codec.idealBitsPerPixel())) * 1.5); v.bitrate(30) != expect {
+			t.Errorf("%s: expected bitrate %d, got %d", v, expect, v.bitrate(30))
+		}
+	}
+
+	// low complexity: the largest size is merged into the next one
+	hls = newBuilder(0)
+	nfo = &hlsfile.ComplexityInfo{Factor: 0.5}
+	hls.applyComplexity(nfo)
+	if s := strings.Join(nfo.Dropped, " "); s != "av1@3840x2160 hevc@3840x2160" {
+		t.Errorf("unexpected dropped variants %s", s)
+	}
+	if v := hls.variants[0]; v.String() != "av1@2560x1440" || v.bitrate(30) != uint64(float64(v.size.bitrate(30, 0.07))*0.5) {
+		t.Errorf("unexpected top variant %s at %d", v, v.bitrate(30))
+	}
+
+	// capped at the source bitrate: larger sizes of the same codec are merged
+	hls = newBuilder(5000000)
+	nfo = &hlsfile.ComplexityInfo{Factor: 2}
+	hls.applyComplexity(nfo)
+	if s := strings.Join(nfo.Dropped, " "); s != "av1@3840x2160 hevc@3840x2160 av1@2560x1440 hevc@2560x1440" {
+		t.Errorf("unexpected dropped variants %s", s)
+	}
+	for _, v := range hls.variants {
+		if v.bitrate(30) > 5000000 {
+			t.Errorf("%s: bitrate %d over the source bitrate", v, v.bitrate(30))
+		}
+	}
+
+	// crf rungs only get their cap scaled, vbr rungs stay under max_rate
+	hls = newBuilder(0)
+	hls.variants = []*hlsVariant{
+		{size: &vsize{1920, 1080}, codec: HEVC, rung: &Rung{Codec: "hevc", CRF: 24, codec: HEVC}},
+		{size: &vsize{1280, 720}, codec: H264, rung: &Rung{Codec: "h264", MaxRate: 3000000, codec: H264}},
+	}
+	hls.applyComplexity(&hlsfile.ComplexityInfo{Factor: 2})
+	if r := hls.variants[0].settings(); r.Bitrate != 0 || r.MaxRate != uint64(float64(hls.variants[0].size.bitrate(30, 0.08)*3/2)*2) || r.validate() != nil {
+		t.Errorf("unexpected crf settings %+v", r)
+	}
+	if r := hls.variants[1].settings(); r.Bitrate != 3000000 || r.validate() != nil {
+		t.Errorf("unexpected vbr settings %+v", r)
+	}
+}
@@ -0,0 +1,851 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// MasterPlaylist is a master (multivariant) playlist
+type MasterPlaylist struct {
+	Version     int
+	Independent bool // EXT-X-INDEPENDENT-SEGMENTS
+	Renditions  []*Rendition
+	Variants    []*Variant
+	IFrames     []*IFrameStream
+	SessionData []*SessionData
+	Tags        []*m3u8spec // other tags, kept as is
+}
+
+// Rendition is an alternative rendition (EXT-X-MEDIA)
+type Rendition struct {
+	Type            string // AUDIO, VIDEO, SUBTITLES or CLOSED-CAPTIONS
+	GroupID         string
+	Name            string
+	Language        string
+	URI             string // empty if the rendition is in the variant streams
+	Default         bool
+	AutoSelect      bool
+	Forced          bool
+	InstreamID      string
+	Characteristics string
+	Channels        string
+	Attrs           []*m3u8attr // other attributes
+}
+
+// StreamInf holds the attributes common to variant streams and I-frame
+// streams
+type StreamInf struct {
+	URI              string
+	Bandwidth        uint64
+	AverageBandwidth uint64 // 0 if unknown
+	Codecs           []string
+	Width, Height    int
+	HDCPLevel        string
+	VideoRange       string
+	Video            string      // group id of video renditions
+	Attrs            []*m3u8attr // other attributes
+}
+
+// Variant is a variant stream (EXT-X-STREAM-INF)
+type Variant struct {
+	StreamInf
+	FrameRate      float64
+	Audio          string // group id of audio renditions
+	Subtitles      string // group id of subtitles renditions
+	ClosedCaptions string // group id of closed captions renditions, or NONE
+}
+
+// IFrameStream is an I-frame only variant (EXT-X-I-FRAME-STREAM-INF)
+type IFrameStream struct {
+	StreamInf
+}
+
+// SessionData is arbitrary data attached to the playlist (EXT-X-SESSION-DATA)
+type SessionData struct {
+	DataID   string
+	Value    string
+	URI      string
+	Language string
+}
+
+// MediaPlaylist is a media playlist listing the segments of a stream
+type MediaPlaylist struct {
+	Version        int
+	TargetDuration int
+	MediaSequence  uint64
+	PlaylistType   string // VOD, EVENT or empty
+	IFramesOnly    bool
+	Independent    bool // EXT-X-INDEPENDENT-SEGMENTS
+	Segments       []*Segment
+	EndList        bool
+	Tags           []*m3u8spec // other tags, kept as is
+}
+
+// Segment is a media segment. Map and Key are set on the first segment they
+// apply to, and apply to all following segments until changed.
+type Segment struct {
+	URI             string
+	Duration        float64
+	Title           string
+	ByteRange       *ByteRange // nil for the whole file
+	Map             *MediaMap
+	Key             *Key
+	Discontinuity   bool
+	ProgramDateTime string
+	DateRanges      []*DateRange
+	Tags            []*m3u8spec // other tags, kept as is
+}
+
+// ByteRange is a sub-range of a file. Offsets not specified in the playlist
+// are resolved when parsing.
+type ByteRange struct {
+	Length int64
+	Offset int64
+}
+
+// MediaMap is the initialization section of following segments (EXT-X-MAP)
+type MediaMap struct {
+	URI       string
+	ByteRange *ByteRange
+}
+
+// Key is the encryption of following segments (EXT-X-KEY)
+type Key struct {
+	Method            string
+	URI               string
+	IV                string // hexadecimal sequence, such as 0x1234
+	KeyFormat         string
+	KeyFormatVersions string
+}
+
+// DateRange is a date range (EXT-X-DATERANGE)
+type DateRange struct {
+	ID              string
+	Class           string
+	StartDate       string
+	EndDate         string
+	Duration        float64 // 0 if not set
+	PlannedDuration float64 // 0 if not set
+	EndOnNext       bool
+	Attrs           []*m3u8attr // other attributes, such as X-<client-attribute>
+}
+
+// parseMaster reads the master playlist fn
+func parseMaster(fn string) (*MasterPlaylist, error) {
+	log.Printf("m3u8: parsing %s", fn)
+
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	res := &MasterPlaylist{}
+	if err := res.parse(f); err != nil {
+		return nil, fmt.Errorf("in %s: %w", fn, err)
+	}
+	return res, nil
+}
+
+// parseMedia reads the media playlist fn
+func parseMedia(fn string) (*MediaPlaylist, error) {
+	log.Printf("m3u8: parsing %s", fn)
+
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	res := &MediaPlaylist{}
+	if err := res.parse(f); err != nil {
+		return nil, fmt.Errorf("in %s: %w", fn, err)
+	}
+	return res, nil
+}
+
+// newVODPlaylist returns an empty VOD media playlist
+func newVODPlaylist(version int) *MediaPlaylist {
+	return &MediaPlaylist{Version: version, PlaylistType: "VOD", EndList: true}
+}
+
+// m3u8BuildVTT returns a playlist with the whole subtitles file fn as single
+// segment
+func m3u8BuildVTT(fn string, duration float64) *MediaPlaylist {
+	pl := newVODPlaylist(6)
+	pl.Tags = append(pl.Tags, &m3u8spec{key: "#EXT-X-ALLOW-CACHE", value: "YES"})
+	pl.AddSegment(fn, duration)
+	return pl
+}
+
+// AddRendition appends a rendition to the playlist
+func (m *MasterPlaylist) AddRendition(typ, groupID, name, uri string) *Rendition {
+	r := &Rendition{Type: typ, GroupID: groupID, Name: name, URI: uri, AutoSelect: true}
+	m.Renditions = append(m.Renditions, r)
+	return r
+}
+
+// AddVariant appends a variant stream to the playlist
+func (m *MasterPlaylist) AddVariant(uri string, bandwidth uint64) *Variant {
+	v := &Variant{StreamInf: StreamInf{URI: uri, Bandwidth: bandwidth}}
+	m.Variants = append(m.Variants, v)
+	return v
+}
+
+// AddIFrameStream appends an I-frame stream to the playlist
+func (m *MasterPlaylist) AddIFrameStream(uri string, bandwidth uint64) *IFrameStream {
+	s := &IFrameStream{StreamInf{URI: uri, Bandwidth: bandwidth}}
+	m.IFrames = append(m.IFrames, s)
+	return s
+}
+
+// Playlists returns the URIs of the media playlists referenced by m, in the
+// order they are written
+func (m *MasterPlaylist) Playlists() []string {
+	var res []string
+	add := func(uri string) {
+		for _, u := range res {
+			if u == uri {
+				return
+			}
+		}
+		res = append(res, uri)
+	}
+	for _, r := range m.Renditions {
+		if r.URI != "" {
+			add(r.URI)
+		}
+	}
+	for _, v := range m.Variants {
+		add(v.URI)
+	}
+	for _, s := range m.IFrames {
+		add(s.URI)
+	}
+	return res
+}
+
+// Rename replaces all media playlist URIs in m by the result of fn
+func (m *MasterPlaylist) Rename(fn func(uri string) string) {
+	for _, r := range m.Renditions {
+		if r.URI != "" {
+			r.URI = fn(r.URI)
+		}
+	}
+	for _, v := range m.Variants {
+		v.URI = fn(v.URI)
+	}
+	for _, s := range m.IFrames {
+		s.URI = fn(s.URI)
+	}
+}
+
+// GroupByCodec reorders variant and I-frame streams so that streams sharing
+// the same video codec are listed together, groups being in order of first
+// appearance
+func (m *MasterPlaylist) GroupByCodec() {
+	rank := make(map[string]int)
+	key := func(s *StreamInf) int {
+		var family string
+		if len(s.Codecs) > 0 {
+			family, _, _ = strings.Cut(s.Codecs[0], ".")
+		}
+		r, ok := rank[family]
+		if !ok {
+			r = len(rank)
+			rank[family] = r
+		}
+		return r
+	}
+	for _, v := range m.Variants {
+		key(&v.StreamInf)
+	}
+	slices.SortStableFunc(m.Variants, func(a, b *Variant) int {
+		return key(&a.StreamInf) - key(&b.StreamInf)
+	})
+	slices.SortStableFunc(m.IFrames, func(a, b *IFrameStream) int {
+		return key(&a.StreamInf) - key(&b.StreamInf)
+	})
+}
+
+// AddSegment appends a segment to the playlist, updating its target duration
+func (pl *MediaPlaylist) AddSegment(uri string, duration float64) *Segment {
+	s := &Segment{URI: uri, Duration: duration}
+	pl.Segments = append(pl.Segments, s)
+	pl.TargetDuration = max(pl.TargetDuration, int(math.Ceil(duration)))
+	return s
+}
+
+// Duration returns the total duration of the segments in pl
+func (pl *MediaPlaylist) Duration() float64 {
+	var res float64
+	for _, s := range pl.Segments {
+		res += s.Duration
+	}
+	return res
+}
+
+// Maps returns all the initialization sections of pl
+func (pl *MediaPlaylist) Maps() []*MediaMap {
+	var res []*MediaMap
+	for _, s := range pl.Segments {
+		if s.Map != nil {
+			res = append(res, s.Map)
+		}
+	}
+	return res
+}
+
+func (m *MasterPlaylist) parse(in io.Reader) error {
+	var v *Variant // waiting for its URI
+
+	err := m3u8Scan(in, func(spec *m3u8spec, uri string) error {
+		if spec == nil {
+			if v == nil {
+				return fmt.Errorf("unexpected URI %q", uri)
+			}
+			v.URI = uri
+			m.Variants = append(m.Variants, v)
+			v = nil
+			return nil
+		}
+		if v != nil {
+			return fmt.Errorf("unexpected %s before variant URI", spec.key)
+		}
+
+		var err error
+		switch spec.key {
+		case "#EXT-X-VERSION":
+			m.Version, err = strconv.Atoi(spec.value)
+		case "#EXT-X-INDEPENDENT-SEGMENTS":
+			m.Independent = true
+		case "#EXT-X-MEDIA":
+			var r *Rendition
+			r, err = parseRendition(spec)
+			m.Renditions = append(m.Renditions, r)
+		case "#EXT-X-STREAM-INF":
+			v = &Variant{}
+			err = v.parse(spec)
+		case "#EXT-X-I-FRAME-STREAM-INF":
+			s := &IFrameStream{}
+			err = s.parse(spec)
+			if err == nil && s.URI == "" {
+				err = errors.New("missing URI in #EXT-X-I-FRAME-STREAM-INF")
+			}
+			m.IFrames = append(m.IFrames, s)
+		case "#EXT-X-SESSION-DATA":
+			m.SessionData = append(m.SessionData, &SessionData{
+				DataID:   spec.get("DATA-ID"),
+				Value:    spec.get("VALUE"),
+				URI:      spec.get("URI"),
+				Language: spec.get("LANGUAGE"),
+			})
+		case "#EXTINF", "#EXT-X-TARGETDURATION":
+			return fmt.Errorf("unexpected %s, not a master playlist", spec.key)
+		default:
+			m.Tags = append(m.Tags, spec)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", spec.key, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if v != nil {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+func parseRendition(spec *m3u8spec) (*Rendition, error) {
+	typ, err := spec.getEnum("TYPE")
+	r := &Rendition{
+		Type:            typ,
+		GroupID:         spec.get("GROUP-ID"),
+		Name:            spec.get("NAME"),
+		Language:        spec.get("LANGUAGE"),
+		URI:             spec.get("URI"),
+		Default:         spec.get("DEFAULT") == "YES",
+		AutoSelect:      spec.get("AUTOSELECT") == "YES",
+		Forced:          spec.get("FORCED") == "YES",
+		InstreamID:      spec.get("INSTREAM-ID"),
+		Characteristics: spec.get("CHARACTERISTICS"),
+		Channels:        spec.get("CHANNELS"),
+		Attrs:           spec.other("TYPE", "GROUP-ID", "NAME", "LANGUAGE", "URI", "DEFAULT", "AUTOSELECT", "FORCED", "INSTREAM-ID", "CHARACTERISTICS", "CHANNELS"),
+	}
+	if err != nil {
+		return r, err
+	}
+	if r.Type == "" || r.GroupID == "" || r.Name == "" {
+		return r, errors.New("TYPE, GROUP-ID and NAME are required")
+	}
+	return r, nil
+}
+
+var streamInfAttrs = []string{"URI", "BANDWIDTH", "AVERAGE-BANDWIDTH", "CODECS", "RESOLUTION", "HDCP-LEVEL", "VIDEO-RANGE", "VIDEO"}
+
+func (s *StreamInf) parse(spec *m3u8spec, known ...string) (err error) {
+	s.URI = spec.get("URI")
+	if s.Bandwidth, err = spec.getInt("BANDWIDTH"); err != nil {
+		return
+	}
+	if spec.has("AVERAGE-BANDWIDTH") {
+		if s.AverageBandwidth, err = spec.getInt("AVERAGE-BANDWIDTH"); err != nil {
+			return
+		}
+	}
+	if c := spec.get("CODECS"); c != "" {
+		s.Codecs = strings.Split(c, ",")
+	}
+	if spec.has("RESOLUTION") {
+		if s.Width, s.Height, err = spec.getResolution("RESOLUTION"); err != nil {
+			return
+		}
+	}
+	if s.HDCPLevel, err = spec.getEnum("HDCP-LEVEL"); err != nil {
+		return
+	}
+	if s.VideoRange, err = spec.getEnum("VIDEO-RANGE"); err != nil {
+		return
+	}
+	s.Video = spec.get("VIDEO")
+	s.Attrs = spec.other(append(known, streamInfAttrs...)...)
+	return nil
+}
+
+func (v *Variant) parse(spec *m3u8spec) (err error) {
+	if err = v.StreamInf.parse(spec, "FRAME-RATE", "AUDIO", "SUBTITLES", "CLOSED-CAPTIONS"); err != nil {
+		return
+	}
+	if spec.has("FRAME-RATE") {
+		if v.FrameRate, err = spec.getFloat("FRAME-RATE"); err != nil {
+			return
+		}
+	}
+	v.Audio = spec.get("AUDIO")
+	v.Subtitles = spec.get("SUBTITLES")
+	v.ClosedCaptions = spec.get("CLOSED-CAPTIONS")
+	return nil
+}
+
+func (pl *MediaPlaylist) parse(in io.Reader) error {
+	seg := &Segment{}
+	var hasInf, pending bool
+	next := make(map[string]int64) // end of the previous sub-range of each file
+	var byteRange string
+
+	err := m3u8Scan(in, func(spec *m3u8spec, uri string) error {
+		if spec == nil {
+			if !hasInf {
+				return fmt.Errorf("unexpected URI %q", uri)
+			}
+			seg.URI = uri
+			if byteRange != "" {
+				ln, off, err := parseByteRange(byteRange, next[uri])
+				if err != nil {
+					return err
+				}
+				seg.ByteRange = &ByteRange{Length: ln, Offset: off}
+				next[uri] = off + ln
+			}
+			pl.Segments = append(pl.Segments, seg)
+			seg = &Segment{}
+			hasInf, pending, byteRange = false, false, ""
+			return nil
+		}
+
+		var err error
+		switch spec.key {
+		case "#EXT-X-VERSION":
+			pl.Version, err = strconv.Atoi(spec.value)
+		case "#EXT-X-TARGETDURATION":
+			pl.TargetDuration, err = strconv.Atoi(spec.value)
+		case "#EXT-X-MEDIA-SEQUENCE":
+			pl.MediaSequence, err = strconv.ParseUint(spec.value, 10, 64)
+		case "#EXT-X-PLAYLIST-TYPE":
+			pl.PlaylistType = spec.value
+		case "#EXT-X-I-FRAMES-ONLY":
+			pl.IFramesOnly = true
+		case "#EXT-X-INDEPENDENT-SEGMENTS":
+			pl.Independent = true
+		case "#EXT-X-ENDLIST":
+			pl.EndList = true
+		case "#EXTINF":
+			if hasInf {
+				return errors.New("unexpected #EXTINF before segment URI")
+			}
+			d, title, _ := strings.Cut(spec.value, ",")
+			seg.Duration, err = strconv.ParseFloat(d, 64)
+			seg.Title = title
+			hasInf, pending = true, true
+		case "#EXT-X-BYTERANGE":
+			byteRange, pending = spec.value, true
+		case "#EXT-X-MAP":
+			seg.Map = &MediaMap{URI: spec.get("URI")}
+			if r := spec.get("BYTERANGE"); r != "" {
+				ln, off, err := parseByteRange(r, 0)
+				if err != nil {
+					return fmt.Errorf("invalid #EXT-X-MAP: %w", err)
+				}
+				seg.Map.ByteRange = &ByteRange{Length: ln, Offset: off}
+			}
+			pending = true
+		case "#EXT-X-KEY":
+			seg.Key = &Key{
+				URI:               spec.get("URI"),
+				IV:                spec.get("IV"),
+				KeyFormat:         spec.get("KEYFORMAT"),
+				KeyFormatVersions: spec.get("KEYFORMATVERSIONS"),
+			}
+			seg.Key.Method, err = spec.getEnum("METHOD")
+			if err == nil && seg.Key.Method == "" {
+				err = errors.New("missing METHOD")
+			}
+			pending = true
+		case "#EXT-X-DISCONTINUITY":
+			seg.Discontinuity, pending = true, true
+		case "#EXT-X-PROGRAM-DATE-TIME":
+			seg.ProgramDateTime, pending = spec.value, true
+		case "#EXT-X-DATERANGE":
+			dr := &DateRange{
+				ID:        spec.get("ID"),
+				Class:     spec.get("CLASS"),
+				StartDate: spec.get("START-DATE"),
+				EndDate:   spec.get("END-DATE"),
+				EndOnNext: spec.get("END-ON-NEXT") == "YES",
+				Attrs:     spec.other("ID", "CLASS", "START-DATE", "END-DATE", "DURATION", "PLANNED-DURATION", "END-ON-NEXT"),
+			}
+			if spec.has("DURATION") {
+				dr.Duration, err = spec.getFloat("DURATION")
+			}
+			if err == nil && spec.has("PLANNED-DURATION") {
+				dr.PlannedDuration, err = spec.getFloat("PLANNED-DURATION")
+			}
+			seg.DateRanges = append(seg.DateRanges, dr)
+			pending = true
+		case "#EXT-X-STREAM-INF", "#EXT-X-MEDIA", "#EXT-X-I-FRAME-STREAM-INF":
+			return fmt.Errorf("unexpected %s, not a media playlist", spec.key)
+		default:
+			if len(pl.Segments) == 0 && !pending {
+				pl.Tags = append(pl.Tags, spec)
+			} else {
+				seg.Tags = append(seg.Tags, spec)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", spec.key, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if pending {
+		return io.ErrUnexpectedEOF
+	}
+	// tags after the last segment
+	pl.Tags = append(pl.Tags, seg.Tags...)
+	return nil
+}
+
+func (r *ByteRange) String() string {
+	return fmt.Sprintf("%d@%d", r.Length, r.Offset)
+}
+
+func (m *MasterPlaylist) WriteTo(w io.Writer) (int64, error) {
+	var lines []*m3u8spec
+	lines = append(lines, &m3u8spec{key: "#EXTM3U"})
+	if m.Version > 0 {
+		lines = append(lines, &m3u8spec{key: "#EXT-X-VERSION", value: strconv.Itoa(m.Version)})
+	}
+	if m.Independent {
+		lines = append(lines, &m3u8spec{key: "#EXT-X-INDEPENDENT-SEGMENTS"})
+	}
+	lines = append(lines, m.Tags...)
+	for _, d := range m.SessionData {
+		spec := &m3u8spec{key: "#EXT-X-SESSION-DATA"}
+		spec.setString("DATA-ID", d.DataID)
+		if d.Value != "" {
+			spec.setString("VALUE", d.Value)
+		}
+		if d.URI != "" {
+			spec.setString("URI", d.URI)
+		}
+		if d.Language != "" {
+			spec.setString("LANGUAGE", d.Language)
+		}
+		lines = append(lines, spec)
+	}
+	for _, r := range m.Renditions {
+		lines = append(lines, r.spec())
+	}
+
+	buf := &bytes.Buffer{}
+	for _, l := range lines {
+		if l.err != nil {
+			return 0, l.err
+		}
+		buf.WriteString(l.String() + "\n")
+	}
+	for _, v := range m.Variants {
+		spec := v.spec()
+		if spec.err != nil {
+			return 0, spec.err
+		}
+		buf.WriteString(spec.String() + "\n")
+		buf.WriteString(v.URI + "\n")
+	}
+	for _, s := range m.IFrames {
+		spec := &m3u8spec{key: "#EXT-X-I-FRAME-STREAM-INF"}
+		s.setAttrs(spec)
+		spec.setString("URI", s.URI)
+		if spec.err != nil {
+			return 0, spec.err
+		}
+		buf.WriteString(spec.String() + "\n")
+	}
+	return buf.WriteTo(w)
+}
+
+func yesNo(v bool) string {
+	if v {
+		return "YES"
+	}
+	return "NO"
+}
+
+func (r *Rendition) spec() *m3u8spec {
+	spec := &m3u8spec{key: "#EXT-X-MEDIA"}
+	spec.setEnum("TYPE", r.Type)
+	spec.setString("GROUP-ID", r.GroupID)
+	spec.setString("NAME", r.Name)
+	if r.Language != "" {
+		spec.setString("LANGUAGE", r.Language)
+	}
+	spec.setEnum("DEFAULT", yesNo(r.Default))
+	spec.setEnum("AUTOSELECT", yesNo(r.AutoSelect))
+	if r.Type == "SUBTITLES" {
+		spec.setEnum("FORCED", yesNo(r.Forced))
+	}
+	if r.InstreamID != "" {
+		spec.setString("INSTREAM-ID", r.InstreamID)
+	}
+	if r.Characteristics != "" {
+		spec.setString("CHARACTERISTICS", r.Characteristics)
+	}
+	if r.Channels != "" {
+		spec.setString("CHANNELS", r.Channels)
+	}
+	if r.URI != "" {
+		spec.setString("URI", r.URI)
+	}
+	spec.attrs = append(spec.attrs, r.Attrs...)
+	return spec
+}
+
+func (s *StreamInf) setAttrs(spec *m3u8spec) {
+	spec.setInt("BANDWIDTH", s.Bandwidth)
+	if s.AverageBandwidth > 0 {
+		spec.setInt("AVERAGE-BANDWIDTH", s.AverageBandwidth)
+	}
+	if len(s.Codecs) > 0 {
+		spec.setString("CODECS", strings.Join(s.Codecs, ","))
+	}
+	if s.Width > 0 {
+		spec.setResolution("RESOLUTION", s.Width, s.Height)
+	}
+	if s.HDCPLevel != "" {
+		spec.setEnum("HDCP-LEVEL", s.HDCPLevel)
+	}
+	if s.VideoRange != "" {
+		spec.setEnum("VIDEO-RANGE", s.VideoRange)
+	}
+	if s.Video != "" {
+		spec.setString("VIDEO", s.Video)
+	}
+	spec.attrs = append(spec.attrs, s.Attrs...)
+}
+
+func (v *Variant) spec() *m3u8spec {
+	spec := &m3u8spec{key: "#EXT-X-STREAM-INF"}
+	v.setAttrs(spec)
+	if v.FrameRate > 0 {
+		spec.setFloat("FRAME-RATE", v.FrameRate)
+	}
+	if v.Audio != "" {
+		spec.setString("AUDIO", v.Audio)
+	}
+	if v.Subtitles != "" {
+		spec.setString("SUBTITLES", v.Subtitles)
+	}
+	switch v.ClosedCaptions {
+	case "":
+	case "NONE":
+		spec.setEnum("CLOSED-CAPTIONS", "NONE")
+	default:
+		spec.setString("CLOSED-CAPTIONS", v.ClosedCaptions)
+	}
+	return spec
+}
+
+func (pl *MediaPlaylist) WriteTo(w io.Writer) (int64, error) {
+	buf := &bytes.Buffer{}
+	var err error
+	line := func(spec *m3u8spec) {
+		if spec.err != nil && err == nil {
+			err = spec.err
+		}
+		buf.WriteString(spec.String() + "\n")
+	}
+
+	line(&m3u8spec{key: "#EXTM3U"})
+	if pl.Version > 0 {
+		line(&m3u8spec{key: "#EXT-X-VERSION", value: strconv.Itoa(pl.Version)})
+	}
+	line(&m3u8spec{key: "#EXT-X-TARGETDURATION", value: strconv.Itoa(pl.TargetDuration)})
+	line(&m3u8spec{key: "#EXT-X-MEDIA-SEQUENCE", value: strconv.FormatUint(pl.MediaSequence, 10)})
+	if pl.PlaylistType != "" {
+		line(&m3u8spec{key: "#EXT-X-PLAYLIST-TYPE", value: pl.PlaylistType})
+	}
+	if pl.IFramesOnly {
+		line(&m3u8spec{key: "#EXT-X-I-FRAMES-ONLY"})
+	}
+	if pl.Independent {
+		line(&m3u8spec{key: "#EXT-X-INDEPENDENT-SEGMENTS"})
+	}
+	for _, t := range pl.Tags {
+		line(t)
+	}
+
+	for _, s := range pl.Segments {
+		if s.Discontinuity {
+			line(&m3u8spec{key: "#EXT-X-DISCONTINUITY"})
+		}
+		if k := s.Key; k != nil {
+			spec := &m3u8spec{key: "#EXT-X-KEY"}
+			spec.setEnum("METHOD", k.Method)
+			if k.URI != "" {
+				spec.setString("URI", k.URI)
+			}
+			if k.IV != "" {
+				spec.set("IV", k.IV)
+			}
+			if k.KeyFormat != "" {
+				spec.setString("KEYFORMAT", k.KeyFormat)
+			}
+			if k.KeyFormatVersions != "" {
+				spec.setString("KEYFORMATVERSIONS", k.KeyFormatVersions)
+			}
+			line(spec)
+		}
+		if s.Map != nil {
+			spec := &m3u8spec{key: "#EXT-X-MAP"}
+			spec.setString("URI", s.Map.URI)
+			if s.Map.ByteRange != nil {
+				spec.setString("BYTERANGE", s.Map.ByteRange.String())
+			}
+			line(spec)
+		}
+		if s.ProgramDateTime != "" {
+			line(&m3u8spec{key: "#EXT-X-PROGRAM-DATE-TIME", value: s.ProgramDateTime})
+		}
+		for _, dr := range s.DateRanges {
+			spec := &m3u8spec{key: "#EXT-X-DATERANGE"}
+			spec.setString("ID", dr.ID)
+			if dr.Class != "" {
+				spec.setString("CLASS", dr.Class)
+			}
+			spec.setString("START-DATE", dr.StartDate)
+			if dr.EndDate != "" {
+				spec.setString("END-DATE", dr.EndDate)
+			}
+			if dr.Duration > 0 {
+				spec.setFloat("DURATION", dr.Duration)
+			}
+			if dr.PlannedDuration > 0 {
+				spec.setFloat("PLANNED-DURATION", dr.PlannedDuration)
+			}
+			spec.attrs = append(spec.attrs, dr.Attrs...)
+			if dr.EndOnNext {
+				spec.setEnum("END-ON-NEXT", "YES")
+			}
+			line(spec)
+		}
+		for _, t := range s.Tags {
+			line(t)
+		}
+		line(&m3u8spec{key: "#EXTINF", value: strconv.FormatFloat(s.Duration, 'f', 6, 64) + "," + s.Title})
+		if s.ByteRange != nil {
+			line(&m3u8spec{key: "#EXT-X-BYTERANGE", value: s.ByteRange.String()})
+		}
+		buf.WriteString(s.URI + "\n")
+	}
+
+	if pl.EndList {
+		line(&m3u8spec{key: "#EXT-X-ENDLIST"})
+	}
+	if err != nil {
+		return 0, err
+	}
+	return buf.WriteTo(w)
+}
+
+// Bytes returns the playlist as written by WriteTo
+func (m *MasterPlaylist) Bytes() ([]byte, error) {
+	buf := &bytes.Buffer{}
+	_, err := m.WriteTo(buf)
+	return buf.Bytes(), err
+}
+
+// Bytes returns the playlist as written by WriteTo
+func (pl *MediaPlaylist) Bytes() ([]byte, error) {
+	buf := &bytes.Buffer{}
+	_, err := pl.WriteTo(buf)
+	return buf.Bytes(), err
+}
+
+func (m *MasterPlaylist) SaveAs(fn string) error {
+	buf, err := m.Bytes()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(fn, buf, 0644)
+}
+
+func (pl *MediaPlaylist) SaveAs(fn string) error {
+	buf, err := pl.Bytes()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(fn, buf, 0644)
+}
+
+// clone returns a deep copy of m
+func (m *MasterPlaylist) clone() (*MasterPlaylist, error) {
+	buf, err := m.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	res := &MasterPlaylist{}
+	return res, res.parse(bytes.NewReader(buf))
+}
+
+// clone returns a deep copy of pl
+func (pl *MediaPlaylist) clone() (*MediaPlaylist, error) {
+	buf, err := pl.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	res := &MediaPlaylist{}
+	return res, res.parse(bytes.NewReader(buf))
+}
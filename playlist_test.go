@@ -0,0 +1,204 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMasterPlaylist(t *testing.T) {
+	src := `#EXTM3U
+#EXT-X-VERSION:6
+#EXT-X-INDEPENDENT-SEGMENTS
+#EXT-X-SESSION-DATA:DATA-ID="com.example.title",VALUE="Movie"
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="audio",NAME="Main, commentary",LANGUAGE="ja",DEFAULT=YES,AUTOSELECT=YES,CHANNELS="2",URI="stream_1.m3u8"
+#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="subs",NAME="English",LANGUAGE="en",DEFAULT=NO,AUTOSELECT=YES,FORCED=NO,URI="stream_2_sub.m3u8"
+#EXT-X-STREAM-INF:BANDWIDTH=2000000,AVERAGE-BANDWIDTH=1500000,CODECS="avc1.640028,mp4a.40.2",RESOLUTION=1920x1080,X-CUSTOM=1,FRAME-RATE=23.976,AUDIO="audio",SUBTITLES="subs",CLOSED-CAPTIONS=NONE
+stream_0.m3u8
+#EXT-X-I-FRAME-STREAM-INF:BANDWIDTH=300000,CODECS="avc1.640028",RESOLUTION=1920x1080,URI="stream_0_iframe.m3u8"
+`
+	m := &MasterPlaylist{}
+	if err := m.parse(strings.NewReader(src)); err != nil {
+		t.Fatalf("failed to parse: %s", err)
+	}
+	out, err := m.Bytes()
+	if err != nil {
+		t.Fatalf("failed to write: %s", err)
+	}
+	if string(out) != src {
+		t.Errorf("round trip mismatch:\n%s\nexpected:\n%s", out, src)
+	}
+
+	if len(m.Variants) != 1 || len(m.Renditions) != 2 || len(m.IFrames) != 1 {
+		t.Fatalf("unexpected playlist %+v", m)
+	}
+	v := m.Variants[0]
+	if v.Bandwidth != 2000000 || len(v.Codecs) != 2 || v.Width != 1920 || v.FrameRate != 23.976 || v.Audio != "audio" {
+		t.Errorf("unexpected variant %+v", v)
+	}
+	if r := m.Renditions[0]; r.Name != "Main, commentary" || !r.Default || r.URI != "stream_1.m3u8" {
+		t.Errorf("unexpected rendition %+v", r)
+	}
+	if pl := m.Playlists(); len(pl) != 4 || pl[2] != "stream_0.m3u8" || pl[3] != "stream_0_iframe.m3u8" {
+		t.Errorf("unexpected playlists %v", pl)
+	}
+
+	m.Rename(func(uri string) string { return "x/" + uri })
+	if m.Variants[0].URI != "x/stream_0.m3u8" || m.IFrames[0].URI != "x/stream_0_iframe.m3u8" {
+		t.Errorf("rename failed")
+	}
+}
+
+func TestMediaPlaylist(t *testing.T) {
+	src := `#EXTM3U
+#EXT-X-VERSION:6
+#EXT-X-TARGETDURATION:6
+#EXT-X-MEDIA-SEQUENCE:0
+#EXT-X-PLAYLIST-TYPE:VOD
+#EXT-X-MAP:URI="init.mp4",BYTERANGE="720@0"
+#EXTINF:6.000000,
+#EXT-X-BYTERANGE:1000@720
+seg.m4s
+#EXT-X-DISCONTINUITY
+#EXT-X-KEY:METHOD=AES-128,URI="key.bin",IV=0x0123456789abcdef
+#EXT-X-DATERANGE:ID="ad",START-DATE="2024-01-01T00:00:00Z",DURATION=4.500,X-AD-ID="42"
+#EXTINF:4.500000,title, with comma
+#EXT-X-BYTERANGE:500@1720
+seg.m4s
+#EXT-X-ENDLIST
+`
+	pl := &MediaPlaylist{}
+	if err := pl.parse(strings.NewReader(src)); err != nil {
+		t.Fatalf("failed to parse: %s", err)
+	}
+	out, err := pl.Bytes()
+	if err != nil {
+		t.Fatalf("failed to write: %s", err)
+	}
+	if string(out) != src {
+		t.Errorf("round trip mismatch:\n%s\nexpected:\n%s", out, src)
+	}
+
+	if len(pl.Segments) != 2 || !pl.EndList || pl.PlaylistType != "VOD" {
+		t.Fatalf("unexpected playlist %+v", pl)
+	}
+	s := pl.Segments[1]
+	if s.Duration != 4.5 || s.Title != "title, with comma" || !s.Discontinuity || s.Key == nil || len(s.DateRanges) != 1 {
+		t.Errorf("unexpected segment %+v", s)
+	}
+	if pl.Segments[0].Map == nil || pl.Segments[0].Map.ByteRange.Length != 720 {
+		t.Errorf("unexpected map %+v", pl.Segments[0].Map)
+	}
+	if pl.Duration() != 10.5 {
+		t.Errorf("unexpected duration %f", pl.Duration())
+	}
+
+	// byte ranges without offset continue the previous range of the same file
+	pl = &MediaPlaylist{}
+	err = pl.parse(strings.NewReader("#EXTM3U\n#EXTINF:1,\n#EXT-X-BYTERANGE:100@50\na.ts\n#EXTINF:1,\n#EXT-X-BYTERANGE:200\na.ts\n#EXT-X-ENDLIST\n"))
+	if err != nil || pl.Segments[1].ByteRange.Offset != 150 {
+		t.Errorf("unexpected byte range %+v (err=%v)", pl.Segments[1].ByteRange, err)
+	}
+}
+
+func TestPlaylistBuilders(t *testing.T) {
+	pl := newVODPlaylist(6)
+	pl.AddSegment("a.m4s", 6).Map = &MediaMap{URI: "init.mp4"}
+	pl.AddSegment("b.m4s", 6.006)
+	if pl.TargetDuration != 7 {
+		t.Errorf("unexpected target duration %d", pl.TargetDuration)
+	}
+
+	m := &MasterPlaylist{Version: 6}
+	r := m.AddRendition("SUBTITLES", "subs", `say "hi"`, "subs.m3u8")
+	r.Language = "en"
+	v := m.AddVariant("video.m3u8", 1000)
+	v.Subtitles = "subs"
+	expect := `#EXTM3U
+#EXT-X-VERSION:6
+#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="subs",NAME="say 'hi'",LANGUAGE="en",DEFAULT=NO,AUTOSELECT=YES,FORCED=NO,URI="subs.m3u8"
+#EXT-X-STREAM-INF:BANDWIDTH=1000,SUBTITLES="subs"
+video.m3u8
+`
+	out, err := m.Bytes()
+	if err != nil {
+		t.Fatalf("failed to write: %s", err)
+	}
+	if string(out) != expect {
+		t.Errorf("unexpected master:\n%s", out)
+	}
+}
+
+func TestPlaylistErrors(t *testing.T) {
+	playlists := map[string]string{
+		"missing header": "#EXT-X-VERSION:6\n",
+		"empty":          "",
+		"uri first":      "#EXTM3U\nseg.ts\n",
+		"truncated":      "#EXTM3U\n#EXTINF:6,\n",
+		"bad attribute":  "#EXTM3U\n#EXT-X-MAP:URI=\"init.mp4\n",
+		"bad duration":   "#EXTM3U\n#EXTINF:abc,\nseg.ts\n",
+		"master tag":     "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1\nv.m3u8\n",
+		"missing method": "#EXTM3U\n#EXT-X-KEY:URI=\"key.bin\"\n#EXTINF:6,\nseg.ts\n",
+		"quoted method":  "#EXTM3U\n#EXT-X-KEY:METHOD=\"AES 128\"\n#EXTINF:6,\nseg.ts\n",
+	}
+	for name, src := range playlists {
+		pl := &MediaPlaylist{}
+		if err := pl.parse(strings.NewReader(src)); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+
+	masters := map[string]string{
+		"media tag":         "#EXTM3U\n#EXTINF:6,\nseg.ts\n",
+		"missing bandwidth": "#EXTM3U\n#EXT-X-STREAM-INF:CODECS=\"avc1\"\nv.m3u8\n",
+		"missing uri":       "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1\n",
+		"missing name":      "#EXTM3U\n#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"a\"\n",
+		"missing type":      "#EXTM3U\n#EXT-X-MEDIA:GROUP-ID=\"a\",NAME=\"a\"\n",
+		"quoted type":       "#EXTM3U\n#EXT-X-MEDIA:TYPE=\"AUDIO\",GROUP-ID=\"a\",NAME=\"a\"\n",
+		"quoted hdcp level": "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1,HDCP-LEVEL=\"TYPE 0\"\nv.m3u8\n",
+		"quoted range":      "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1,VIDEO-RANGE=\"S DR\"\nv.m3u8\n",
+	}
+	for name, src := range masters {
+		m := &MasterPlaylist{}
+		if err := m.parse(strings.NewReader(src)); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestPlaylistWriteErrors(t *testing.T) {
+	m := &MasterPlaylist{}
+	m.AddVariant("v.m3u8", 1000).VideoRange = "S DR"
+	if _, err := m.Bytes(); err == nil {
+		t.Errorf("expected error writing invalid VIDEO-RANGE")
+	}
+
+	pl := newVODPlaylist(6)
+	pl.AddSegment("a.m4s", 6).Key = &Key{URI: "key.bin"}
+	if _, err := pl.Bytes(); err == nil {
+		t.Errorf("expected error writing key without METHOD")
+	}
+	if _, err := pl.clone(); err == nil {
+		t.Errorf("expected error cloning key without METHOD")
+	}
+}
+
+func TestGroupByCodec(t *testing.T) {
+	m := &MasterPlaylist{}
+	for _, c := range []string{"av01.0.08M.08", "hvc1.1.6.L120.90", "avc1.640028", "av01.0.05M.08", "hvc1.1.6.L93.90", "avc1.64001f"} {
+		m.AddVariant(c+".m3u8", 1000).Codecs = []string{c, "mp4a.40.2"}
+	}
+	m.AddIFrameStream("i_avc1.m3u8", 100).Codecs = []string{"avc1.640028"}
+	m.AddIFrameStream("i_av01.m3u8", 100).Codecs = []string{"av01.0.08M.08"}
+	m.GroupByCodec()
+
+	var order []string
+	for _, v := range m.Variants {
+		order = append(order, v.Codecs[0])
+	}
+	if strings.Join(order, " ") != "av01.0.08M.08 av01.0.05M.08 hvc1.1.6.L120.90 hvc1.1.6.L93.90 avc1.640028 avc1.64001f" {
+		t.Errorf("unexpected order %v", order)
+	}
+	if m.IFrames[0].URI != "i_av01.m3u8" {
+		t.Errorf("unexpected I-frame order")
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/KarpelesLab/hlsmaker/hlsfile"
+)
+
+var (
+	measureQuality = flag.Bool("quality", false, "measure SSIM, PSNR and VMAF (when ffmpeg has libvmaf) of each video variant against the scaled source")
+	qualityReport  = flag.String("quality_report", "", "write the quality report of video variants as JSON to this file (implies -quality)")
+	qualityFail    = flag.Bool("quality_fail", false, "fail when a variant is below a quality threshold instead of only warning")
+	minSSIM        = flag.Float64("min_ssim", 0, "minimum SSIM of video variants (0 to disable)")
+	minPSNR        = flag.Float64("min_psnr", 0, "minimum PSNR of video variants in dB (0 to disable)")
+	minVMAF        = flag.Float64("min_vmaf", 0, "minimum VMAF of video variants (0 to disable)")
+)
+
+// qualityEnabled returns true if quality should be measured after encoding
+func qualityEnabled() bool {
+	return *measureQuality || *qualityReport != ""
+}
+
+// measureVariantsQuality computes the quality of each encoded video variant,
+// writes the report if requested and checks thresholds
+func (hls *hlsBuilder) measureVariantsQuality() error {
+	vmaf := ffmpegHas("filters", "libvmaf")
+	if !vmaf {
+		log.Printf("quality: ffmpeg has no libvmaf, skipping VMAF")
+	}
+
+	var failed []string
+	for n, v := range hls.variants {
+		// variants are the first streams, see encodeVideo
+		ts := hls.streams[n]
+		q, err := hls.variantQuality(ts, v, vmaf)
+		if err != nil {
+			return fmt.Errorf("while measuring quality of %s: %w", v, err)
+		}
+		v.quality = q
+
+		if q.VMAF != 0 {
+			log.Printf("quality: %s SSIM %.4f PSNR %.2f dB VMAF %.2f", v, q.SSIM, q.PSNR, q.VMAF)
+		} else {
+			log.Printf("quality: %s SSIM %.4f PSNR %.2f dB", v, q.SSIM, q.PSNR)
+		}
+		if len(q.BelowThreshold) > 0 {
+			log.Printf("quality: warning: %s is below the minimum %s", v, strings.Join(q.BelowThreshold, ", "))
+			failed = append(failed, v.String())
+		}
+	}
+
+	if *qualityReport != "" {
+		buf, err := json.MarshalIndent(hls.variantInfo(), "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(*qualityReport, append(buf, '\n'), 0644); err != nil {
+			return err
+		}
+	}
+
+	if len(failed) > 0 && *qualityFail {
+		return fmt.Errorf("variants below quality thresholds: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// variantQuality compares the stream ts encoded for v to the source, with
+// the same filters and scaled to the size of v
+func (hls *hlsBuilder) variantQuality(ts *hlsStream, v *hlsVariant, vmaf bool) (*hlsfile.QualityInfo, error) {
+	prefix := fmt.Sprintf("quality_%d", ts.id)
+	ssimLog, psnrLog, vmafLog := prefix+"_ssim.log", prefix+"_psnr.log", prefix+"_vmaf.json"
+
+	logs := []string{ssimLog, psnrLog}
+	if vmaf {
+		logs = append(logs, vmafLog)
+	}
+	flt := qualityFilter(v, hls.frameRate(), logs)
+
+	args := []string{"-hide_banner", "-loglevel", "error",
+		"-i", ts.Filename(),
+		"-i", hls.input,
+		"-filter_complex", flt,
+		"-f", "null", "-",
+	}
+	if *verboseMode {
+		log.Printf("ffmpeg arguments: %v", args)
+	}
+	c := exec.Command(exe("ffmpeg"), args...)
+	c.Dir = hls.dir // set to run in temp dir
+	c.Stdout = os.Stdout
+	c.Stderr = os.Stderr
+	if err := c.Run(); err != nil {
+		return nil, fmt.Errorf("failed to run ffmpeg: %w", err)
+	}
+
+	res := &hlsfile.QualityInfo{}
+	var err error
+	if res.SSIM, err = statsMean(filepath.Join(hls.dir, ssimLog), "All"); err != nil {
+		return nil, err
+	}
+	mse, err := statsMean(filepath.Join(hls.dir, psnrLog), "mse_avg")
+	if err != nil {
+		return nil, err
+	}
+	res.PSNR = psnr(mse)
+	if vmaf {
+		if res.VMAF, err = vmafMean(filepath.Join(hls.dir, vmafLog)); err != nil {
+			return nil, err
+		}
+	}
+
+	if *minSSIM > 0 && res.SSIM < *minSSIM {
+		res.BelowThreshold = append(res.BelowThreshold, "ssim")
+	}
+	if *minPSNR > 0 && res.PSNR < *minPSNR {
+		res.BelowThreshold = append(res.BelowThreshold, "psnr")
+	}
+	if *minVMAF > 0 && vmaf && res.VMAF < *minVMAF {
+		res.BelowThreshold = append(res.BelowThreshold, "vmaf")
+	}
+	return res, nil
+}
+
+// qualityFilter returns the filter graph comparing the encoded stream of v
+// (input 0) to the source (input 1), with the same filters and scaled to the
+// size of v. Both are retimed to start at zero and resampled to rate, the
+// frame rate of the encode, so that VFR, high frame rate or offset sources
+// are compared frame by frame, up to the shortest of the two. logs are the
+// ssim, psnr and optionally libvmaf log files.
+func qualityFilter(v *hlsVariant, rate float64, logs []string) string {
+	metrics := len(logs)
+	retime := ",setpts=PTS-STARTPTS,fps=" + strconv.FormatFloat(rate, 'f', -1, 64) + ",format=yuv420p"
+
+	ref := "[1:v:0]"
+	if *videoFilters != "" {
+		ref += *videoFilters + ","
+	}
+	ref += v.size.Scale() + retime
+
+	flt := fmt.Sprintf("[0:v:0]%s,split=%d", retime[1:], metrics)
+	for n := 0; n < metrics; n++ {
+		flt += fmt.Sprintf("[d%d]", n)
+	}
+	flt += fmt.Sprintf(";%s,split=%d", ref, metrics)
+	for n := 0; n < metrics; n++ {
+		flt += fmt.Sprintf("[r%d]", n)
+	}
+	flt += ";[d0][r0]ssim=shortest=1:stats_file=" + logs[0]
+	flt += ";[d1][r1]psnr=shortest=1:stats_file=" + logs[1]
+	if metrics > 2 {
+		flt += ";[d2][r2]libvmaf=shortest=1:log_fmt=json:log_path=" + logs[2]
+	}
+	return flt
+}
+
+// statsMean returns the mean of the values of key in a ssim or psnr filter
+// stats file, where each line holds "key:value" fields for a frame
+func statsMean(fn, key string) (float64, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var total float64
+	var cnt int
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		for _, field := range strings.Fields(s.Text()) {
+			k, val, ok := strings.Cut(field, ":")
+			if !ok || k != key {
+				continue
+			}
+			v, err := strconv.ParseFloat(val, 64)
+			if err != nil {
+				return 0, fmt.Errorf("in %s: invalid %s: %w", filepath.Base(fn), key, err)
+			}
+			total += v
+			cnt += 1
+		}
+	}
+	if err := s.Err(); err != nil {
+		return 0, err
+	}
+	if cnt == 0 {
+		return 0, fmt.Errorf("no %s value in %s", key, filepath.Base(fn))
+	}
+	return total / float64(cnt), nil
+}
+
+// psnr returns the PSNR in dB of 8 bits samples for the given mean squared
+// error, capped at 100 for identical pictures
+func psnr(mse float64) float64 {
+	if mse <= 0 {
+		return 100
+	}
+	return min(100, 10*math.Log10(255*255/mse))
+}
+
+// vmafMean returns the pooled mean VMAF score of a libvmaf json log
+func vmafMean(fn string) (float64, error) {
+	buf, err := os.ReadFile(fn)
+	if err != nil {
+		return 0, err
+	}
+	var res struct {
+		Pooled map[string]struct {
+			Mean float64 `json:"mean"`
+		} `json:"pooled_metrics"`
+	}
+	if err := json.Unmarshal(buf, &res); err != nil {
+		return 0, fmt.Errorf("in %s: %w", filepath.Base(fn), err)
+	}
+	m, ok := res.Pooled["vmaf"]
+	if !ok {
+		return 0, errors.New("no pooled vmaf score in libvmaf log")
+	}
+	return m.Mean, nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestQualityStats(t *testing.T) {
+	dir := t.TempDir()
+
+	ssim := filepath.Join(dir, "ssim.log")
+	os.WriteFile(ssim, []byte("n:1 Y:0.990000 U:0.995000 V:0.995000 All:0.992000 (20.969100)\nn:2 Y:0.980000 U:0.990000 V:0.990000 All:0.984000 (17.958800)\n"), 0644)
+	if v, err := statsMean(ssim, "All"); err != nil || math.Abs(v-0.988) > 1e-9 {
+		t.Errorf("unexpected ssim %f (%v)", v, err)
+	}
+
+	psnrLog := filepath.Join(dir, "psnr.log")
+	os.WriteFile(psnrLog, []byte("n:1 mse_avg:6.50 mse_y:8.00 mse_u:3.50 mse_v:3.50 psnr_avg:39.99\nn:2 mse_avg:6.50 mse_y:8.00 mse_u:3.50 mse_v:3.50 psnr_avg:39.99\n"), 0644)
+	mse, err := statsMean(psnrLog, "mse_avg")
+	if err != nil || mse != 6.5 {
+		t.Errorf("unexpected mse %f (%v)", mse, err)
+	}
+	if p := psnr(mse); math.Abs(p-40.0017) > 1e-3 {
+		t.Errorf("unexpected psnr %f", p)
+	}
+	if p := psnr(0); p != 100 {
+		t.Errorf("unexpected psnr %f for identical pictures", p)
+	}
+	if _, err := statsMean(psnrLog, "All"); err == nil {
+		t.Errorf("expected error for missing key")
+	}
+
+	vmaf := filepath.Join(dir, "vmaf.json")
+	os.WriteFile(vmaf, []byte(`{"version": "2.3.1", "frames": [], "pooled_metrics": {"vmaf": {"min": 80.1, "max": 99.2, "mean": 93.25}}}`), 0644)
+	if v, err := vmafMean(vmaf); err != nil || v != 93.25 {
+		t.Errorf("unexpected vmaf %f (%v)", v, err)
+	}
+}
+
+func TestQualityFilter(t *testing.T) {
+	v := &hlsVariant{size: &vsize{1280, 720}, codec: H264}
+	flt := qualityFilter(v, 30, []string{"ssim.log", "psnr.log"})
+	expect := "[0:v:0]setpts=PTS-STARTPTS,fps=30,format=yuv420p,split=2[d0][d1]" +
+		";[1:v:0]" + v.size.Scale() + ",setpts=PTS-STARTPTS,fps=30,format=yuv420p,split=2[r0][r1]" +
+		";[d0][r0]ssim=shortest=1:stats_file=ssim.log" +
+		";[d1][r1]psnr=shortest=1:stats_file=psnr.log"
+	if flt != expect {
+		t.Errorf("unexpected filter graph:\n%s\nexpected:\n%s", flt, expect)
+	}
+
+	// source filters apply to the reference only, both sides share the
+	// clamped encoder frame rate
+	old := *videoFilters
+	t.Cleanup(func() { *videoFilters = old })
+	*videoFilters = "yadif"
+	flt = qualityFilter(v, 29.97, []string{"ssim.log", "psnr.log", "vmaf.json"})
+	for _, s := range []string{
+		"[0:v:0]setpts=PTS-STARTPTS,fps=29.97,format=yuv420p,split=3[d0][d1][d2];",
+		";[1:v:0]yadif," + v.size.Scale() + ",setpts=PTS-STARTPTS,fps=29.97,format=yuv420p,split=3[r0][r1][r2];",
+		";[d2][r2]libvmaf=shortest=1:log_fmt=json:log_path=vmaf.json",
+	} {
+		if !strings.Contains(flt, s) {
+			t.Errorf("filter graph %s does not contain %s", flt, s)
+		}
+	}
+}
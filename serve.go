@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/KarpelesLab/hlsmaker/hlsfile"
+)
+
+var (
+	listenAddr = flag.String("listen", ":8080", "address to listen on in serve mode")
+)
+
+type hlsServer struct {
+	f *hlsfile.File
+}
+
+// serveCommand serves a packed hls file over http, for local testing
+func serveCommand(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: serve [-listen addr] file.hls")
+	}
+
+	f, err := hlsfile.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	log.Printf("serve: %s (%d entries) available at http://%s/master.m3u8", args[0], len(f.Entries), *listenAddr)
+	return http.ListenAndServe(*listenAddr, &hlsServer{f: f})
+}
+
+func (s *hlsServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	e, err := s.f.Lookup(strings.TrimPrefix(req.URL.Path, "/"))
+	if err != nil {
+		http.NotFound(w, req)
+		return
+	}
+
+	hdr := w.Header()
+	hdr.Set("Content-Type", e.ContentType())
+	hdr.Set("Access-Control-Allow-Origin", "*")
+	// the timestamp changes each time the file is built
+	hdr.Set("ETag", fmt.Sprintf(`"%x-%s"`, s.f.Created.Unix(), e.Name()))
+
+	// ServeContent takes care of Range and conditional requests
+	http.ServeContent(w, req, e.Name(), s.f.Created, s.f.Reader(e))
+}
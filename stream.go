@@ -2,6 +2,9 @@ package main
 
 import (
 	"fmt"
+	"path"
+	"strconv"
+	"strings"
 
 	"github.com/KarpelesLab/ffprobe"
 )
@@ -17,6 +20,9 @@ type hlsStream struct {
 	lid int             // stream number per type
 	typ byte            // 'v', 'a' or 's' depending if video/audio/subtitle stream
 	src *ffprobe.Stream // source stream
+
+	audio       *AudioRung // audio encoding settings, audio streams only
+	passthrough bool       // audio copied from the source instead of encoded with audio
 }
 
 // newStream return a new stream with the correct id set
@@ -49,6 +55,36 @@ func (s *hlsStream) Filename() string {
 	}
 }
 
+// playlistName returns the name of the media playlist of the stream
+func (s *hlsStream) playlistName() string {
+	return fmt.Sprintf("stream_%d.m3u8", s.id)
+}
+
+// Language returns the stream language for use in playlists, or an empty
+// string if unknown
+func (s *hlsStream) Language() string {
+	lng := s.languageTag()
+	if len(lng) > 2 {
+		// TODO better map language
+		lng = lng[:2]
+	}
+	return lng
+}
+
+// languageTag returns the language tag of the source stream, keeping only
+// letters, digits and dashes as it comes from the input file and is used in
+// output paths
+func (s *hlsStream) languageTag() string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-':
+			return r
+		default:
+			return -1
+		}
+	}, s.src.Tags["language"])
+}
+
 func (s *hlsStream) Typename() string {
 	switch s.typ {
 	case AudioStream:
@@ -61,3 +97,44 @@ func (s *hlsStream) Typename() string {
 		return ""
 	}
 }
+
+// streamOf returns the stream a work file such as "stream_3_12.m4s" belongs
+// to, and the remaining part of the filename ("_12.m4s"), or nil if the file
+// does not match any stream
+func (hls *hlsBuilder) streamOf(fn string) (*hlsStream, string) {
+	rest, ok := strings.CutPrefix(path.Base(fn), "stream_")
+	if !ok {
+		return nil, ""
+	}
+	pos := strings.IndexFunc(rest, func(r rune) bool { return r < '0' || r > '9' })
+	if pos == -1 {
+		pos = len(rest)
+	}
+	id, err := strconv.Atoi(rest[:pos])
+	if err != nil || id >= len(hls.streams) {
+		return nil, ""
+	}
+	return hls.streams[id], rest[pos:]
+}
+
+// label returns a human readable name for the stream, such as
+// "video_1920x1080_hevc" or "audio_0_jpn"
+func (hls *hlsBuilder) label(s *hlsStream) string {
+	switch s.typ {
+	case VideoStream:
+		if s.lid < len(hls.variants) {
+			v := hls.variants[s.lid]
+			return fmt.Sprintf("video_%s_%s", v.size, v.codec)
+		}
+		return fmt.Sprintf("video_%d", s.lid)
+	default:
+		res := fmt.Sprintf("%s_%d", s.Typename(), s.lid)
+		if s.typ == SubsStream {
+			res = fmt.Sprintf("subs_%d", s.lid)
+		}
+		if lng := s.languageTag(); lng != "" {
+			res += "_" + lng
+		}
+		return res
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/KarpelesLab/ffprobe"
+)
+
+func TestStreamLabel(t *testing.T) {
+	hls := &hlsBuilder{}
+	tests := []struct {
+		lang, label, language string
+	}{
+		{"jpn", "audio_0_jpn", "jp"},
+		{"x/../../../tmp", "audio_0_xtmp", "xt"},
+		{"pt-BR", "audio_0_pt-BR", "pt"},
+		{"../..", "audio_0", ""},
+	}
+	for _, tt := range tests {
+		s := &hlsStream{typ: AudioStream, src: &ffprobe.Stream{CodecType: "audio", Tags: map[string]string{"language": tt.lang}}}
+		if l := hls.label(s); l != tt.label {
+			t.Errorf("language %q: expected label %s, got %s", tt.lang, tt.label, l)
+		}
+		if l := s.Language(); l != tt.language {
+			t.Errorf("language %q: expected %q, got %q", tt.lang, tt.language, l)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+)
+
+var (
+	twoPass = flag.Bool("two_pass", false, "use two-pass encoding for software encoders (libx264, libx265, libaom) in cbr and vbr rate control, slower but better quality")
+)
+
+// passLogFile returns the prefix of the pass log files of variant n, in hls.dir
+func passLogFile(n int) string {
+	return fmt.Sprintf("pass_%d", n)
+}
+
+// twoPassCapable returns true if args use an encoder supporting two-pass
+// encoding
+func (args CodecArgs) twoPassCapable() bool {
+	switch args.encoder() {
+	case "libx264", "libx265", "libaom-av1":
+		return true
+	default:
+		return false
+	}
+}
+
+// encoder returns the name of the encoder selected by args
+func (args CodecArgs) encoder() string {
+	for _, a := range args {
+		if a.K == "-c" {
+			return a.V
+		}
+	}
+	return ""
+}
+
+// withPass returns a copy of args for the given pass of a two-pass encoding,
+// using logfile for statistics
+func (args CodecArgs) withPass(pass int, logfile string) CodecArgs {
+	res := make(CodecArgs, 0, len(args)+2)
+	if args.encoder() != "libx265" {
+		res = append(res, args...)
+		return append(res, &codecArg{"-pass", strconv.Itoa(pass)}, &codecArg{"-passlogfile", logfile})
+	}
+
+	// libx265 ignores -pass, stats are set in x265-params
+	params := fmt.Sprintf("pass=%d:stats=%s.log", pass, logfile)
+	found := false
+	for _, a := range args {
+		if a.K == "-x265-params" {
+			a = &codecArg{a.K, a.V + ":" + params}
+			found = true
+		}
+		res = append(res, a)
+	}
+	if !found {
+		res = append(res, &codecArg{"-x265-params", params})
+	}
+	return res
+}
+
+// analysisPass runs the first pass of two-pass encoding for the variants
+// listed in analysed, codecArgs[n] being the codec arguments of variant n.
+// The source is split with the same filters as the final pass so that pass
+// logs match the encoded frames.
+func (hls *hlsBuilder) analysisPass(codecArgs []CodecArgs, analysed []int) error {
+	var variants []*hlsVariant
+	for _, n := range analysed {
+		variants = append(variants, hls.variants[n])
+	}
+	log.Printf("running analysis pass for %v", variants)
+
+	args := hls.inputArgs()
+	args = append(args, "-filter_complex", hls.filterComplex(variants))
+	for k, n := range analysed {
+		args = append(args, "-map", fmt.Sprintf("[v%d]", k))
+		args = append(args, codecArgs[n].withPass(1, passLogFile(n)).Expand()...)
+		args = append(args, "-an", "-f", "null", os.DevNull)
+	}
+
+	if *verboseMode {
+		log.Printf("ffmpeg arguments: %v", args)
+	}
+	c := exec.Command(exe("ffmpeg"), args...)
+	c.Dir = hls.dir // pass logs are written in temp dir
+	c.Stdout = os.Stdout
+	c.Stderr = os.Stderr
+
+	if err := c.Run(); err != nil {
+		return fmt.Errorf("analysis pass failed: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"strings"
+
+	"github.com/KarpelesLab/hlsmaker/hlsfile"
+)
+
+var (
+	verifyProbe = flag.Bool("probe", false, "also check each media entry with ffprobe in verify mode")
+)
+
+// verifyCommand checks the consistency of a packed hls file
+func verifyCommand(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: verify [-probe] file.hls")
+	}
+
+	f, err := hlsfile.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	errs := f.Verify()
+	if len(errs) == 0 && *verifyProbe {
+		errs = probeEntries(f)
+	}
+	if len(errs) > 0 {
+		for _, err := range errs {
+			log.Printf("verify: %s", err)
+		}
+		return fmt.Errorf("%d problems found in %s", len(errs), args[0])
+	}
+
+	log.Printf("verify: %s is valid (%d entries)", args[0], len(f.Entries))
+	return nil
+}
+
+// probeEntries runs ffprobe on each media entry referenced from playlists,
+// prepending the init segment when there is one
+func probeEntries(f *hlsfile.File) []error {
+	var res []error
+	done := make(map[string]bool)
+
+	for _, pl := range f.Entries {
+		if pl.Type() != hlsfile.FilePlaylist {
+			continue
+		}
+		refs, err := f.Refs(pl)
+		if err != nil {
+			res = append(res, fmt.Errorf("playlist %s: %w", pl.Name(), err))
+			continue
+		}
+		for _, ref := range refs {
+			if done[ref.URI] || strings.HasSuffix(ref.URI, ".m3u8") {
+				continue
+			}
+			done[ref.URI] = true
+			if err := probeEntry(f, ref); err != nil {
+				res = append(res, fmt.Errorf("entry %s: ffprobe failed: %w", ref.URI, err))
+			}
+		}
+	}
+	return res
+}
+
+func probeEntry(f *hlsfile.File, ref *hlsfile.Ref) error {
+	var in []io.Reader
+	for _, name := range []string{ref.Map, ref.URI} {
+		if name == "" {
+			continue
+		}
+		e, err := f.Lookup(name)
+		if err != nil {
+			return err
+		}
+		in = append(in, f.Reader(e))
+	}
+
+	stderr := &bytes.Buffer{}
+	c := exec.Command(exe("ffprobe"), "-hide_banner", "-loglevel", "error", "-show_streams", "-i", "pipe:0")
+	c.Stdin = io.MultiReader(in...)
+	c.Stderr = stderr
+
+	if err := c.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("%w: %s", err, msg)
+		}
+		return err
+	}
+	return nil
+}
@@ -34,17 +34,37 @@ func (v *vsize) smaller() *vsize {
 		if v.h <= nh {
 			continue
 		}
-		// calculate new width maintaining aspect ratio, round to nearest even number
-		nw := (v.w * nh / v.h) &^ 1 // integer division then clear last bit to make even
-		if nw < 160 || nh < 160 {
-			// too small
-			return nil
-		}
-		return &vsize{w: nw, h: nh}
+		return v.scale(nh)
 	}
 	return nil
 }
 
+// scale returns v scaled to height nh maintaining aspect ratio, or nil if
+// the result would be too small
+func (v *vsize) scale(nh int) *vsize {
+	// calculate new width maintaining aspect ratio, round to nearest even number
+	nw := (v.w * nh / v.h) &^ 1 // integer division then clear last bit to make even
+	if nw < 160 || nh < 160 {
+		// too small
+		return nil
+	}
+	return &vsize{w: nw, h: nh}
+}
+
+// resize returns v scaled so that its smallest side, the height unless the
+// video is vertical, is n
+func (v *vsize) resize(n int) *vsize {
+	if v.w < v.h {
+		return v.reverse().scale(n).reverse()
+	}
+	return v.scale(n)
+}
+
+// short returns the smallest side of v
+func (v *vsize) short() int {
+	return min(v.w, v.h)
+}
+
 func (v *vsize) reverse() *vsize {
 	if v == nil {
 		return nil
@@ -57,17 +77,3 @@ func (v *vsize) bitrate(framerate, bitsPerPixel float64) uint64 {
 	// 1080p@60fps is ~6Mbps
 	return uint64(float64(v.w) * float64(v.h) * framerate * bitsPerPixel)
 }
-
-func (v *vsize) variants() []*hlsVariant {
-	// make a smart variant depending on the size
-	if v.isOver(1280) {
-		return []*hlsVariant{
-			&hlsVariant{size: v, codec: AV1},
-			&hlsVariant{size: v, codec: HEVC},
-		}
-	} else {
-		return []*hlsVariant{
-			&hlsVariant{size: v, codec: H264},
-		}
-	}
-}